@@ -2,47 +2,171 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
 // Dialer is a type which represents the client settings to establish a
 // WebSocket connection.
 type Dialer struct {
+	// HandshakeTimeout specifies the duration for the whole opening handshake: dialing,
+	// the proxy negotiation, the TLS handshake and the HTTP upgrade. Zero means no timeout.
 	HandshakeTimeout time.Duration
-	TLSConfig        *tls.Config
 
-	wsKey string
+	// TLSConfig specifies the TLS configuration of the wss connections. If ServerName
+	// isn't set, the host of the URL is used. NextProtos is always http/1.1. The state
+	// of the TLS connection is available from the TLS field of the handshake response
+	// and Conn.ConnectionState.
+	TLSConfig *tls.Config
+
+	// NetDialContext specifies the function which opens the network connection
+	// to the server or the proxy. If NetDialContext is nil, net.Dialer is used.
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// NetDialTLSContext specifies the function which opens the TLS connection to the
+	// server for wss URLs. The TLS handshake must be performed by the function, so
+	// TLSConfig isn't used. NetDialTLSContext isn't used if the connection is made
+	// through the proxy.
+	NetDialTLSContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Proxy specifies the function which returns the proxy URL for the handshake
+	// request. If the function returns nil URL, no proxy is used. If Proxy is nil,
+	// http.ProxyFromEnvironment is used.
+	//
+	// The supported proxy schemes are http (CONNECT tunnel) and socks5 (or socks5h).
+	// The user info of the proxy URL is used for the Basic proxy authentication
+	// or SOCKS5 username/password authentication. The wss connections perform
+	// the TLS handshake with the server over the tunnel.
+	Proxy func(req *http.Request) (*url.URL, error)
+
+	// MaxRedirects specifies the maximum number of the redirects (301, 302, 303, 307
+	// and 308 responses) followed during the handshake. Zero means the redirects aren't
+	// followed and the redirect response fails the handshake.
+	//
+	// The http and https locations are dialed as ws and wss URLs. The locations on the same
+	// scheme and host are dialed on the same endpoint, e.g. the same Unix domain socket.
+	// The Authorization and Cookie headers of the request header aren't sent to the other
+	// hosts and from the https to the http locations, the Host header is kept only for
+	// the relative locations. The cookies of the Jar are sent to every host.
+	// HandshakeTimeout covers all redirects.
+	MaxRedirects int
+	// CheckRedirect specifies the policy for handling the redirects. It's called before
+	// following the redirect with the upcoming request and the requests made already,
+	// oldest first. The request header may be modified by CheckRedirect. If CheckRedirect
+	// returns an error, DialContext returns the previous response and the error.
+	CheckRedirect func(req *http.Request, via []*http.Request) error
+
+	// SchemeResolvers specifies the resolvers of the URL schemes in addition to the
+	// built-in ws, wss, ws+unix and wss+unix schemes, which may be overridden as well.
+	// The resolver returns the network address to dial and the URL of the handshake request.
+	SchemeResolvers map[string]SchemeResolver
+
+	// WriteBufferSize specifies the size of the connection's write buffer and the message
+	// writer's buffer in bytes, which is the maximum payload size of the frames written
+	// by the message writer. If WriteBufferSize is zero, 4096 bytes are used.
+	WriteBufferSize int
+	// WriteBufferPool specifies the pool of the message writer's buffers. See
+	// Upgrader.WriteBufferPool for details.
+	WriteBufferPool BufferPool
+
+	// ReadBufferPool specifies the pool of the buffers used by Conn.ReadMessage.
+	// See Conn.SetReadBufferPool for details.
+	ReadBufferPool BufferPool
+
+	// ReadLimit and FrameReadLimit specify the maximum sizes in bytes of the message
+	// and the frame payload received from the peer. Zero means no limit.
+	// See Conn.SetReadLimit and Conn.SetFrameReadLimit for details.
+	ReadLimit      int64
+	FrameReadLimit int64
+
+	// KeepaliveInterval and KeepaliveTimeout enable the keepalive of the connection
+	// if KeepaliveInterval is positive. See Conn.EnableKeepalive for details.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+
+	// MaskKeySource specifies the source of the masking keys of the frames sent
+	// to the server. If MaskKeySource is nil, crypto/rand.Reader is used.
+	// A deterministic source may be set in tests to get reproducible frames,
+	// but it must not be used in production: RFC 6455 requires the masking
+	// keys to be unpredictable.
+	MaskKeySource io.Reader
+
+	// Subprotocols specifies the client's requested subprotocols in order of preference.
+	Subprotocols []string
+
+	// EnableCompression specifies whether the client should offer
+	// the permessage-deflate extension (RFC 7692) to the server.
+	EnableCompression bool
+	// CompressionOptions specifies the permessage-deflate parameters
+	// offered to the server if EnableCompression is true.
+	CompressionOptions CompressionOptions
+
+	// Jar specifies the cookie jar. The cookies of the jar are sent in the handshake
+	// request, the cookies set by the server in the handshake response are stored
+	// in the jar. If Jar is nil, cookies are only sent if they are set in the request header.
+	Jar http.CookieJar
+}
+
+// maxErrorBodySize is the maximum size of the response body which is read
+// if the server rejects the handshake.
+const maxErrorBodySize = 1024
+
+// reservedRequestHeaders are the canonical keys of the headers which are set
+// by the Dialer itself and can't be passed in the request header.
+var reservedRequestHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
 }
 
 // Dial creates a new client WebSocket connection using DialContext with a background context.
-func (d *Dialer) Dial(urlStr string) (*Conn, error) {
-	return d.DialContext(context.Background(), urlStr)
+func (d *Dialer) Dial(urlStr string, requestHeader http.Header) (*Conn, *http.Response, error) {
+	return d.DialContext(context.Background(), urlStr, requestHeader)
 }
 
 // DialContext creates a new client WebSocket connection.
 //
-// At first, it opens a new tcp connection over which it sends http handshake
+// At first, it opens a new network connection over which it sends http handshake
 // request for switching protocol to WebSocket. If handshake fails, DialContext returns
-// HandshakeError with detailed reason about error.
-func (d *Dialer) DialContext(ctx context.Context, urlStr string) (*Conn, error) {
-	addr, err := url.Parse(urlStr)
+// HandshakeError with detailed reason about error. If ctx is done before the handshake
+// is complete, dialing or the handshake is aborted and the error wraps ctx.Err().
+//
+// The server's handshake response is returned even if the handshake fails, so the
+// application can inspect the status, headers and cookies of the rejected upgrade.
+// In that case the response body is already read (at most 1024 bytes) and closed,
+// its content is available from resp.Body.
+//
+// The ws and wss URLs are dialed over tcp. The ws+unix and wss+unix URLs are dialed
+// over the Unix domain socket, the socket path is followed by the colon and the request
+// path, e.g. ws+unix:///run/app.sock:/chat. The other schemes may be supported
+// by the Dialer's SchemeResolvers.
+//
+// The requestHeader is included in the handshake request. Use it to specify the origin
+// (Origin), authorization, cookies (Cookie) and other application headers. The Host header
+// overrides the host of the request. The headers negotiated by the Dialer itself can't be
+// set in the requestHeader.
+func (d *Dialer) DialContext(
+	ctx context.Context, urlStr string, requestHeader http.Header,
+) (*Conn, *http.Response, error) {
+	u, err := url.Parse(urlStr)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	switch addr.Scheme {
-	case "ws":
-		addr.Scheme = "http"
-	case "wss":
-		addr.Scheme = "https"
-	default:
-		return nil, fmt.Errorf("bad url schema (must be ws or wss)")
+	ep, err := d.resolveEndpoint(u)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	if d.HandshakeTimeout != 0 {
@@ -52,89 +176,396 @@ func (d *Dialer) DialContext(ctx context.Context, urlStr string) (*Conn, error)
 		defer cancel()
 	}
 
-	wsKey, err := randomWebsocketKey()
+	var (
+		via  []*http.Request
+		resp *http.Response
+	)
+
+	for {
+		wsKey, err := randomWebsocketKey()
+		if err != nil {
+			return nil, resp, err
+		}
+
+		req, err := d.prepareHandshakeRequest(ctx, ep.URL, wsKey, requestHeader)
+		if err != nil {
+			return nil, resp, err
+		}
+
+		if err = d.checkRedirect(req, via, resp); err != nil {
+			return nil, resp, err
+		}
+
+		var conn *Conn
+
+		conn, resp, err = d.dialEndpoint(ctx, ep, req, wsKey)
+		if err == nil {
+			return conn, resp, nil
+		}
+
+		location, ok := d.redirectLocation(resp)
+		if !ok {
+			return nil, resp, err
+		}
+
+		via = append(via, req)
+
+		ep, requestHeader, err = d.redirectEndpoint(ep, req, location, requestHeader)
+		if err != nil {
+			return nil, resp, err
+		}
+	}
+}
+
+// dialEndpoint opens the connection to the server's endpoint and performs
+// the opening handshake sending the request.
+func (d *Dialer) dialEndpoint(
+	ctx context.Context, ep *Endpoint, req *http.Request, wsKey string,
+) (*Conn, *http.Response, error) {
+	netConn, proxyURL, err := d.dial(ctx, ep, req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	conn, resp, err := d.handshake(ctx, netConn, ep, proxyURL, req, wsKey)
+	if err != nil {
+		_ = netConn.Close()
+
+		return nil, resp, err
 	}
 
-	d.wsKey = wsKey
+	return conn, resp, nil
+}
 
-	req, err := d.prepareHandshakeRequest(ctx, addr.String())
+// dial opens the network connection to the server's endpoint or to the proxy
+// if the proxy URL is returned.
+func (d *Dialer) dial(ctx context.Context, ep *Endpoint, req *http.Request) (net.Conn, *url.URL, error) {
+	proxyURL, err := d.proxyURL(ep, req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if proxyURL != nil {
+		hostPort, err := proxyHostPort(proxyURL)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		netConn, err := d.netDial(ctx, "tcp", hostPort)
+
+		return netConn, proxyURL, err
+	}
+
+	if ep.URL.Scheme == "https" && d.NetDialTLSContext != nil {
+		netConn, err := d.NetDialTLSContext(ctx, ep.Network, ep.Addr)
+
+		return netConn, nil, err
+	}
+
+	netConn, err := d.netDial(ctx, ep.Network, ep.Addr)
+
+	return netConn, nil, err
+}
+
+// proxyURL returns the URL of the proxy for the tcp endpoint.
+func (d *Dialer) proxyURL(ep *Endpoint, req *http.Request) (*url.URL, error) {
+	if ep.Network != "tcp" {
+		return nil, nil
+	}
+
+	if d.Proxy != nil {
+		return d.Proxy(req)
+	}
+
+	return http.ProxyFromEnvironment(req)
+}
+
+func (d *Dialer) netDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.NetDialContext != nil {
+		return d.NetDialContext(ctx, network, addr)
 	}
 
-	netConn, err := net.Dial("tcp", extractHostPort(addr))
+	var dialer net.Dialer
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// handshake performs the opening handshake over the network connection
+// and returns the WebSocket connection. The handshake is aborted when ctx is done.
+func (d *Dialer) handshake(
+	ctx context.Context, netConn net.Conn, ep *Endpoint, proxyURL *url.URL, req *http.Request, wsKey string,
+) (*Conn, *http.Response, error) {
+	netConn, r, resp, err := d.upgradeContext(ctx, netConn, ep, proxyURL, req, wsKey)
 	if err != nil {
-		return nil, err
+		return nil, resp, err
+	}
+
+	params, ok, err := d.acceptCompression(resp.Header)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	subprotocol, err := d.acceptSubprotocol(resp.Header)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	writeBufferSize := d.WriteBufferSize
+	if writeBufferSize <= 0 {
+		writeBufferSize = defaultWriteBufferSize
+	}
+
+	conn := newConn(netConn, bufio.NewReadWriter(r, bufio.NewWriterSize(netConn, writeBufferSize)), false)
+	conn.subprotocol = subprotocol
+	conn.response = resp
+	conn.configure(connOptions{
+		writeBufferSize:   writeBufferSize,
+		writeBufferPool:   d.WriteBufferPool,
+		readBufferPool:    d.ReadBufferPool,
+		readLimit:         d.ReadLimit,
+		frameReadLimit:    d.FrameReadLimit,
+		keepaliveInterval: d.KeepaliveInterval,
+		keepaliveTimeout:  d.KeepaliveTimeout,
+	})
+
+	if d.MaskKeySource != nil {
+		conn.maskKeys = newMaskKeyGenerator(d.MaskKeySource)
+	}
+
+	if ok {
+		conn.enableCompression(params)
+	}
+
+	return conn, resp, nil
+}
+
+// upgradeContext is like upgrade, but it aborts the handshake when ctx is done.
+func (d *Dialer) upgradeContext(
+	ctx context.Context, netConn net.Conn, ep *Endpoint, proxyURL *url.URL, req *http.Request, wsKey string,
+) (net.Conn, *bufio.Reader, *http.Response, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		if err := netConn.SetDeadline(deadline); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	var (
+		r    *bufio.Reader
+		resp *http.Response
+	)
+
+	err, ctxErr := runInterruptible(ctx, hasDeadline, netConn.SetDeadline, func() (err error) {
+		netConn, r, resp, err = d.upgrade(netConn, ep, proxyURL, req, wsKey)
+
+		return err
+	})
+	if ctxErr != nil {
+		return nil, nil, resp, fmt.Errorf("handshake is aborted: %w", ctxErr)
+	}
+
+	if err != nil {
+		return nil, nil, resp, err
+	}
+
+	if err = netConn.SetDeadline(time.Time{}); err != nil {
+		return nil, nil, resp, err
+	}
+
+	return netConn, r, resp, nil
+}
+
+// upgrade establishes the tunnel through the proxy if proxyURL isn't nil, performs
+// the TLS handshake for the https request and sends the upgrade request.
+// It returns the connection to the server and the server's response.
+func (d *Dialer) upgrade(
+	netConn net.Conn, ep *Endpoint, proxyURL *url.URL, req *http.Request, wsKey string,
+) (net.Conn, *bufio.Reader, *http.Response, error) {
+	if proxyURL != nil {
+		if err := connectProxy(netConn, proxyURL, ep.Addr); err != nil {
+			return nil, nil, nil, err
+		}
 	}
 
-	if addr.Scheme == "https" {
-		tlsConn, err := d.tlsHandshake(netConn)
+	if ep.URL.Scheme == "https" && (proxyURL != nil || d.NetDialTLSContext == nil) {
+		tlsConn, err := d.tlsHandshake(req.Context(), netConn, ep.URL)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 
 		netConn = tlsConn
 	}
 
-	if err = req.Write(netConn); err != nil {
-		return nil, err
+	if err := req.Write(netConn); err != nil {
+		return nil, nil, nil, err
 	}
 
 	r := bufio.NewReader(netConn)
-	if err = d.handleHandshakeResponse(r, req); err != nil {
-		return nil, err
+
+	resp, err := d.handleHandshakeResponse(r, req, wsKey)
+	if resp != nil {
+		if tlsConn, ok := netConn.(interface {
+			ConnectionState() tls.ConnectionState
+		}); ok {
+			state := tlsConn.ConnectionState()
+			resp.TLS = &state
+		}
+
+		// The cookies of the rejected or redirected handshake are stored as well.
+		if d.Jar != nil {
+			if cookies := resp.Cookies(); len(cookies) > 0 {
+				d.Jar.SetCookies(req.URL, cookies)
+			}
+		}
 	}
 
-	return &Conn{
-		conn: netConn,
-		rw:   bufio.NewReadWriter(r, bufio.NewWriter(netConn)),
-	}, nil
+	if err != nil {
+		return nil, nil, resp, err
+	}
+
+	return netConn, r, resp, nil
 }
 
-func (d *Dialer) prepareHandshakeRequest(ctx context.Context, addr string) (*http.Request, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr, nil)
+func (d *Dialer) prepareHandshakeRequest(
+	ctx context.Context, addr *url.URL, wsKey string, requestHeader http.Header,
+) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 
+	for key, values := range requestHeader {
+		key = http.CanonicalHeaderKey(key)
+
+		switch {
+		case containsString(reservedRequestHeaders, key):
+			return nil, newHandshakeError(HandshakeReservedHeader, 0, key+" header can't be set by the application")
+		case key == "Host":
+			if len(values) > 0 {
+				req.Host = values[0]
+			}
+		default:
+			req.Header[key] = values
+		}
+	}
+
+	if d.Jar != nil {
+		for _, cookie := range d.Jar.Cookies(addr) {
+			req.AddCookie(cookie)
+		}
+	}
+
 	req.Header.Set("Upgrade", "WebSocket")
 	req.Header.Set("Connection", "Upgrade")
-	req.Header.Set("Sec-WebSocket-Key", d.wsKey)
+	req.Header.Set("Sec-WebSocket-Key", wsKey)
 	req.Header.Set("Sec-WebSocket-Version", "13")
 
+	if len(d.Subprotocols) != 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(d.Subprotocols, ", "))
+	}
+
+	if d.EnableCompression {
+		offer := deflateParams{
+			serverNoContextTakeover: d.CompressionOptions.ServerNoContextTakeover,
+			clientNoContextTakeover: d.CompressionOptions.ClientNoContextTakeover,
+		}
+		req.Header.Set("Sec-WebSocket-Extensions", offer.String())
+	}
+
 	return req, nil
 }
 
-func (d *Dialer) handleHandshakeResponse(r *bufio.Reader, req *http.Request) error {
+// handleHandshakeResponse reads and validates the server's handshake response.
+// If the server responds with the status other than 101, the response is returned
+// with the first maxErrorBodySize bytes of the body which have already been read.
+func (d *Dialer) handleHandshakeResponse(r *bufio.Reader, req *http.Request, wsKey string) (*http.Response, error) {
 	resp, err := http.ReadResponse(r, req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer func() { _ = resp.Body.Close() }()
-
 	if resp.StatusCode != http.StatusSwitchingProtocols {
-		return HandshakeError{"bad status code, expect status switching protocols (101)"}
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		_ = resp.Body.Close()
+
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return resp, err
+		}
+
+		return resp, newHandshakeError(
+			HandshakeBadStatus,
+			resp.StatusCode,
+			fmt.Sprintf("bad status code %d, expect status switching protocols (101)", resp.StatusCode),
+		)
 	}
 
+	_ = resp.Body.Close()
+
 	if !checkHeaderContains(resp.Header, "Upgrade", "WebSocket") {
-		return HandshakeError{"response Upgrade header value doesn't equal WebSocket"}
+		return resp, newBadResponseError("response Upgrade header value doesn't equal WebSocket")
 	}
 
 	if !checkHeaderContains(resp.Header, "Connection", "Upgrade") {
-		return HandshakeError{"response Connection header value doesn't equal Upgrade"}
+		return resp, newBadResponseError("response Connection header value doesn't equal Upgrade")
 	}
 
-	if resp.Header.Get("Sec-Websocket-Accept") != hashWebsocketKey(d.wsKey) {
-		return HandshakeError{"bad calculated Sec-Websocket-Accept header value"}
+	if resp.Header.Get("Sec-Websocket-Accept") != hashWebsocketKey(wsKey) {
+		return resp, newBadResponseError("bad calculated Sec-Websocket-Accept header value")
 	}
 
-	return nil
+	return resp, nil
 }
 
-func (d *Dialer) tlsHandshake(netConn net.Conn) (*tls.Conn, error) {
+func newBadResponseError(text string) HandshakeError {
+	return newHandshakeError(HandshakeBadResponse, http.StatusSwitchingProtocols, text)
+}
+
+// acceptSubprotocol returns the subprotocol selected by the server.
+// The server must select one of the offered subprotocols or none.
+func (d *Dialer) acceptSubprotocol(header http.Header) (string, error) {
+	selected := headerValues(header, "Sec-WebSocket-Protocol")
+
+	switch {
+	case len(selected) == 0:
+		return "", nil
+	case len(selected) > 1:
+		return "", newBadResponseError("server selected more than one subprotocol")
+	case !containsString(d.Subprotocols, selected[0]):
+		return "", newBadResponseError("server selected subprotocol which wasn't offered")
+	}
+
+	return selected[0], nil
+}
+
+// acceptCompression returns the permessage-deflate parameters accepted by the server.
+// If the server responds with unknown extension or invalid parameters, the handshake fails.
+func (d *Dialer) acceptCompression(header http.Header) (deflateParams, bool, error) {
+	exts, err := parseExtensions(header)
+	if err != nil {
+		return deflateParams{}, false, err
+	}
+
+	switch {
+	case len(exts) == 0:
+		return deflateParams{}, false, nil
+	case !d.EnableCompression || len(exts) > 1 || exts[0].name != deflateExtensionName:
+		return deflateParams{}, false, newBadResponseError("server accepted extensions which weren't offered")
+	}
+
+	params, ok := acceptDeflateResponse(exts[0].params, d.CompressionOptions)
+	if !ok {
+		return deflateParams{}, false, newBadResponseError("server accepted invalid permessage-deflate parameters")
+	}
+
+	return params, true, nil
+}
+
+// tlsHandshake performs the TLS handshake with the server over the network connection.
+// If TLSConfig doesn't specify ServerName, the host of the URL is verified. The ALPN
+// protocol is always http/1.1, so the server doesn't negotiate HTTP/2 on which
+// the upgrade isn't possible.
+func (d *Dialer) tlsHandshake(ctx context.Context, netConn net.Conn, u *url.URL) (*tls.Conn, error) {
 	var tlsConfig *tls.Config
 	if d.TLSConfig != nil {
 		tlsConfig = d.TLSConfig.Clone()
@@ -142,8 +573,14 @@ func (d *Dialer) tlsHandshake(netConn net.Conn) (*tls.Conn, error) {
 		tlsConfig = &tls.Config{}
 	}
 
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	tlsConfig.NextProtos = []string{"http/1.1"}
+
 	tlsConn := tls.Client(netConn, tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
 		return nil, err
 	}
 
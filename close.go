@@ -0,0 +1,252 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+	"unicode/utf8"
+)
+
+// States of the connection.
+const (
+	// stateOpen means that the close frame has been neither sent nor received.
+	stateOpen = iota
+	// stateClosing means that the closing handshake has been started.
+	stateClosing
+	// stateClosed means that the network connection has been closed.
+	stateClosed
+)
+
+const (
+	// defaultCloseTimeout is the default time to wait for the peer's close frame.
+	defaultCloseTimeout = 5 * time.Second
+	// abnormalCloseTimeout is the time given to write the close frame when
+	// the connection is failed.
+	abnormalCloseTimeout = time.Second
+	// maxCloseReasonSize is the maximum length of the close reason, which
+	// must fit the control frame payload together with the status code.
+	maxCloseReasonSize = maxControlPayloadSize - 2
+)
+
+// SetCloseTimeout sets the time to wait for the peer's close frame during
+// the closing handshake initiated by Close and CloseWithReason. The default
+// timeout is 5 seconds.
+func (c *Conn) SetCloseTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	c.closeTimeout = timeout
+	c.mu.Unlock()
+}
+
+// Close closes the connection performing the closing handshake. If the connection
+// has failed because of the protocol error, the close frame has the status code of
+// the error. If the peer has initiated the closing handshake, the close frame has
+// the peer's status code. Otherwise, the close frame has CloseNormalClosure status code.
+//
+// See CloseWithReason for details.
+func (c *Conn) Close() error {
+	code := CloseNormalClosure
+	if closeErr := c.getCloseError(); closeErr != nil {
+		code = closeErr.Code
+	}
+
+	if code != CloseNoStatusReceived && !isValidReceivedCloseCode(code) {
+		code = CloseNormalClosure
+	}
+
+	return c.closeWith(code, "")
+}
+
+// CloseWithReason closes the connection performing the closing handshake. It sends
+// the close frame with the status code and the reason which must be valid UTF-8
+// text of at most 123 bytes. After that it waits for the peer's close frame at most
+// the close timeout (see SetCloseTimeout) and closes the network connection.
+//
+// The close frame is sent only once: if it has already been sent, CloseWithReason
+// just waits for the peer. If the peer's close frame has already been received,
+// the network connection is closed immediately. If the network connection has already
+// been closed, CloseWithReason returns nil after the completed closing handshake
+// and net.ErrClosed otherwise.
+//
+// While waiting, the close frame is received by the application's reading goroutine
+// if it's reading the connection. Otherwise, CloseWithReason reads the connection
+// itself discarding the received messages.
+func (c *Conn) CloseWithReason(code int, reason string) error {
+	if !isValidReceivedCloseCode(code) {
+		return errInvalidCloseCode
+	}
+
+	if len(reason) > maxCloseReasonSize {
+		return errTooLongCloseReason
+	}
+
+	if !utf8.ValidString(reason) {
+		return errInvalidCloseReason
+	}
+
+	return c.closeWith(code, reason)
+}
+
+func (c *Conn) closeWith(code int, reason string) error {
+	if c.getState() == stateClosed {
+		if c.isCloseCompleted() {
+			return nil
+		}
+
+		return net.ErrClosed
+	}
+
+	c.mu.Lock()
+	deadline := time.Now().Add(c.closeTimeout)
+	c.mu.Unlock()
+
+	if err := c.writeClose(code, reason, deadline); err != nil && !errors.Is(err, errCloseSent) {
+		_ = c.closeNetConn()
+
+		return err
+	}
+
+	// The peer isn't waited for if its close frame has been received or the connection has failed.
+	if c.getCloseError() == nil {
+		c.waitCloseFrame(deadline)
+	}
+
+	return c.closeNetConn()
+}
+
+// isCloseCompleted reports whether the close frame has been both sent and received.
+func (c *Conn) isCloseCompleted() bool {
+	select {
+	case <-c.closeReceived:
+	default:
+		return false
+	}
+
+	c.writeMu <- struct{}{}
+	defer func() { <-c.writeMu }()
+
+	return c.closeSent
+}
+
+// waitCloseFrame waits for the peer's close frame until the deadline. If there is no
+// reader, it reads the connection itself.
+func (c *Conn) waitCloseFrame(deadline time.Time) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case c.readMu <- struct{}{}:
+		defer func() { <-c.readMu }()
+
+		// The read deadline isn't restored, because the connection is closed after that.
+		if err := c.conn.SetReadDeadline(deadline); err != nil {
+			return
+		}
+
+		for {
+			if _, err := c.receive(); err != nil {
+				return
+			}
+		}
+	case <-c.closeReceived:
+	case <-timer.C:
+	}
+}
+
+// writeClose writes the close frame. CloseNoStatusReceived status code
+// means that the frame has no payload.
+func (c *Conn) writeClose(code int, reason string, deadline time.Time) error {
+	var payload []byte
+
+	if code != CloseNoStatusReceived {
+		payload = make([]byte, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		copy(payload[2:], reason)
+	}
+
+	return c.WriteControl(CloseOpcode, payload, deadline)
+}
+
+// receiveClose saves the peer's close frame as the closure error.
+func (c *Conn) receiveClose(closeErr *CloseError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closeErr = closeErr
+	if c.state == stateOpen {
+		c.state = stateClosing
+	}
+
+	select {
+	case <-c.closeReceived:
+	default:
+		close(c.closeReceived)
+	}
+}
+
+// defaultCloseHandler replies to the peer's close frame if the close frame
+// hasn't been sent yet and closes the network connection.
+func (c *Conn) defaultCloseHandler(code int, _ string) error {
+	err := c.writeClose(code, "", time.Now().Add(abnormalCloseTimeout))
+	if errors.Is(err, errCloseSent) {
+		err = nil
+	}
+
+	if closeErr := c.closeNetConn(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// closeAbnormally tries to send the close frame with the code and closes the network
+// connection without waiting for the peer. The reading methods return closeErr after that.
+func (c *Conn) closeAbnormally(code int, closeErr *CloseError) {
+	_ = c.setCloseError(closeErr)
+	_ = c.writeClose(code, "", time.Now().Add(abnormalCloseTimeout))
+	_ = c.closeNetConn()
+}
+
+// closeNetConn closes the network connection. The repeated call has no effect.
+func (c *Conn) closeNetConn() error {
+	var err error
+
+	c.closeOnce.Do(func() {
+		c.setState(stateClosed)
+		close(c.closed)
+
+		err = c.conn.Close()
+	})
+
+	return err
+}
+
+func (c *Conn) setState(state int) {
+	c.mu.Lock()
+	if state > c.state {
+		c.state = state
+	}
+	c.mu.Unlock()
+}
+
+func (c *Conn) getState() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+func (c *Conn) setCloseError(err *CloseError) error {
+	c.mu.Lock()
+	c.closeErr = err
+	c.mu.Unlock()
+
+	return err
+}
+
+func (c *Conn) getCloseError() *CloseError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closeErr
+}
@@ -0,0 +1,172 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newRawPeerConn returns the client connection whose peer records the received
+// bytes without replying. The recorded bytes are sent to the returned channel
+// when the client closes the network connection.
+func newRawPeerConn(t *testing.T) (*Conn, <-chan []byte) {
+	t.Helper()
+
+	clientConn, peer := net.Pipe()
+	client := newConn(clientConn, bufio.NewReadWriter(bufio.NewReader(clientConn), bufio.NewWriter(clientConn)), false)
+	received := make(chan []byte, 1)
+
+	go func() {
+		b, _ := io.ReadAll(peer)
+		received <- b
+	}()
+
+	t.Cleanup(func() {
+		_ = client.closeNetConn()
+		_ = peer.Close()
+	})
+
+	return client, received
+}
+
+// TestClosePeerInitiated checks that closing the connection after the completed
+// closing handshake initiated by the peer succeeds.
+func TestClosePeerInitiated(t *testing.T) {
+	client, server := newPipeConns(t, defaultWriteBufferSize)
+
+	readErr := make(chan error, 1)
+
+	go func() {
+		readErr <- readUntilError(server, nil)
+	}()
+
+	if err := client.CloseWithReason(CloseGoingAway, "bye"); err != nil {
+		t.Fatal(err)
+	}
+
+	var closeErr *CloseError
+	if err := <-readErr; !errors.As(err, &closeErr) || closeErr.Code != CloseGoingAway {
+		t.Fatalf("expected going away closure, got %v", err)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("expected nil error closing after the closing handshake, got %v", err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("expected nil error closing again, got %v", err)
+	}
+}
+
+// TestCloseTimeout checks that the network connection is closed after the close
+// timeout if the peer doesn't reply.
+func TestCloseTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	client, _ := newRawPeerConn(t)
+	client.SetCloseTimeout(timeout)
+
+	start := time.Now()
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 10*timeout {
+		t.Fatalf("expected close after %v, got %v", timeout, elapsed)
+	}
+
+	// The closing handshake hasn't been completed.
+	if err := client.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected closed error, got %v", err)
+	}
+}
+
+// TestCloseFrameSentOnce checks that the close frame is sent once
+// by the concurrent closing calls.
+func TestCloseFrameSentOnce(t *testing.T) {
+	client, received := newRawPeerConn(t)
+	client.SetCloseTimeout(50 * time.Millisecond)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_ = client.CloseWithReason(CloseNormalClosure, "bye")
+		}()
+	}
+
+	wg.Wait()
+
+	if err := client.WriteControl(CloseOpcode, nil, time.Time{}); !errors.Is(err, errCloseSent) {
+		t.Fatalf("expected close sent error, got %v", err)
+	}
+
+	// The masked close frame: the header, the mask key, the status code and the reason.
+	const frameSize = 2 + 4 + 2 + len("bye")
+
+	b := <-received
+	if len(b) != frameSize || b[0] != 0x80|CloseOpcode {
+		t.Fatalf("expected single close frame of %d bytes, got %x", frameSize, b)
+	}
+}
+
+func TestCloseWithReasonInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		reason  string
+		wantErr error
+	}{
+		{
+			name:    "no status received code",
+			code:    CloseNoStatusReceived,
+			wantErr: errInvalidCloseCode,
+		},
+		{
+			name:    "abnormal closure code",
+			code:    CloseAbnormalClosure,
+			wantErr: errInvalidCloseCode,
+		},
+		{
+			name:    "code out of range",
+			code:    999,
+			wantErr: errInvalidCloseCode,
+		},
+		{
+			name:    "too long reason",
+			code:    CloseNormalClosure,
+			reason:  strings.Repeat("a", maxCloseReasonSize+1),
+			wantErr: errTooLongCloseReason,
+		},
+		{
+			name:    "invalid UTF-8 reason",
+			code:    CloseNormalClosure,
+			reason:  "bye\xff",
+			wantErr: errInvalidCloseReason,
+		},
+	}
+
+	client, _ := newRawPeerConn(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := client.CloseWithReason(tt.code, tt.reason); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if state := client.getState(); state != stateOpen {
+				t.Fatalf("expected open connection, got state %d", state)
+			}
+		})
+	}
+}
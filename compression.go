@@ -0,0 +1,424 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	deflateExtensionName = "permessage-deflate"
+
+	serverNoContextTakeover = "server_no_context_takeover"
+	clientNoContextTakeover = "client_no_context_takeover"
+	serverMaxWindowBits     = "server_max_window_bits"
+	clientMaxWindowBits     = "client_max_window_bits"
+
+	minWindowBits = 8
+	maxWindowBits = 15
+
+	// maxWindowSize is the size of the LZ77 sliding window used by compress/flate.
+	maxWindowSize = 1 << maxWindowBits
+
+	minCompressionLevel     = flate.HuffmanOnly
+	maxCompressionLevel     = flate.BestCompression
+	defaultCompressionLevel = flate.BestSpeed
+)
+
+// deflateTail is appended to the compressed payload of the message before
+// decompressing. The first four bytes are the tail removed by the sender (RFC 7692, 7.2.2),
+// the rest is a final empty stored block which makes the flate reader return io.EOF.
+const deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+// CompressionOptions is a type which represents the permessage-deflate
+// extension (RFC 7692) parameters which are negotiated during the handshake.
+type CompressionOptions struct {
+	// ServerNoContextTakeover prevents the server from reusing the compression
+	// context (LZ77 sliding window) of the previous messages.
+	ServerNoContextTakeover bool
+	// ClientNoContextTakeover prevents the client from reusing the compression
+	// context (LZ77 sliding window) of the previous messages.
+	ClientNoContextTakeover bool
+}
+
+// deflateParams is a type which represents the accepted parameters
+// of the permessage-deflate extension.
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+}
+
+func (p deflateParams) String() string {
+	params := []string{deflateExtensionName}
+	if p.serverNoContextTakeover {
+		params = append(params, serverNoContextTakeover)
+	}
+
+	if p.clientNoContextTakeover {
+		params = append(params, clientNoContextTakeover)
+	}
+
+	return strings.Join(params, "; ")
+}
+
+// acceptDeflateOffer returns the parameters of the first permessage-deflate offer
+// which can be accepted by the server. The server declines offers which require
+// to limit its LZ77 sliding window, because compress/flate always uses the maximum one.
+func acceptDeflateOffer(offers []extension, opts CompressionOptions) (deflateParams, bool) {
+	for _, offer := range offers {
+		if offer.name != deflateExtensionName {
+			continue
+		}
+
+		params := deflateParams{
+			serverNoContextTakeover: opts.ServerNoContextTakeover,
+			clientNoContextTakeover: opts.ClientNoContextTakeover,
+		}
+
+		if acceptDeflateParams(offer.params, &params) {
+			return params, true
+		}
+	}
+
+	return deflateParams{}, false
+}
+
+func acceptDeflateParams(offer map[string]string, params *deflateParams) bool {
+	for name, value := range offer {
+		switch name {
+		case serverNoContextTakeover:
+			if value != "" {
+				return false
+			}
+
+			params.serverNoContextTakeover = true
+		case clientNoContextTakeover:
+			if value != "" {
+				return false
+			}
+
+			params.clientNoContextTakeover = true
+		case serverMaxWindowBits:
+			if bits, ok := parseWindowBits(value); !ok || bits != maxWindowBits {
+				return false
+			}
+		case clientMaxWindowBits:
+			// The client is just able to limit its window, the server has no need in it.
+			if _, ok := parseWindowBits(value); value != "" && !ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// acceptDeflateResponse validates the permessage-deflate parameters
+// accepted by the server in the handshake response.
+func acceptDeflateResponse(accepted map[string]string, opts CompressionOptions) (deflateParams, bool) {
+	params := deflateParams{clientNoContextTakeover: opts.ClientNoContextTakeover}
+
+	for name, value := range accepted {
+		switch name {
+		case serverNoContextTakeover:
+			params.serverNoContextTakeover = true
+		case clientNoContextTakeover:
+			params.clientNoContextTakeover = true
+		case serverMaxWindowBits:
+			// The client is able to decompress payload with any window size.
+			if _, ok := parseWindowBits(value); !ok {
+				return params, false
+			}
+
+			continue
+		default:
+			// The client_max_window_bits isn't offered, so the server mustn't respond with it.
+			return params, false
+		}
+
+		if value != "" {
+			return params, false
+		}
+	}
+
+	if opts.ServerNoContextTakeover && !params.serverNoContextTakeover {
+		return params, false
+	}
+
+	return params, true
+}
+
+func parseWindowBits(value string) (int, bool) {
+	if value == "" || value[0] == '0' {
+		return 0, false
+	}
+
+	bits, err := strconv.Atoi(value)
+	if err != nil || bits < minWindowBits || bits > maxWindowBits {
+		return 0, false
+	}
+
+	return bits, true
+}
+
+func isValidCompressionLevel(level int) bool {
+	return level >= minCompressionLevel && level <= maxCompressionLevel
+}
+
+// compressor is a type which holds the compression context of the connection.
+type compressor struct {
+	noContextTakeover bool
+	level             int
+
+	tw *truncWriter
+	fw *flate.Writer
+}
+
+func newCompressor(noContextTakeover bool) *compressor {
+	return &compressor{
+		noContextTakeover: noContextTakeover,
+		level:             defaultCompressionLevel,
+		tw:                &truncWriter{},
+	}
+}
+
+func (c *compressor) setLevel(level int) {
+	if c.level != level {
+		c.level = level
+		c.fw = nil
+	}
+}
+
+// writer returns the flate writer which writes compressed bytes to w.
+func (c *compressor) writer(w io.Writer) (*flate.Writer, error) {
+	c.tw.reset(w)
+
+	if c.fw == nil {
+		fw, err := flate.NewWriter(c.tw, c.level)
+		if err != nil {
+			return nil, err
+		}
+
+		c.fw = fw
+	} else if c.noContextTakeover {
+		c.fw.Reset(c.tw)
+	}
+
+	return c.fw, nil
+}
+
+// truncWriter is a type which forwards bytes to the underlying writer
+// except the last four bytes, which are the tail of the flushed deflate block.
+type truncWriter struct {
+	w    io.Writer
+	n    int
+	tail [4]byte
+}
+
+func (w *truncWriter) reset(dst io.Writer) {
+	w.w = dst
+	w.n = 0
+}
+
+func (w *truncWriter) Write(p []byte) (int, error) {
+	n := 0
+
+	if w.n < len(w.tail) {
+		n = copy(w.tail[w.n:], p)
+		p = p[n:]
+		w.n += n
+
+		if len(p) == 0 {
+			return n, nil
+		}
+	}
+
+	m := len(p)
+	if m > len(w.tail) {
+		m = len(w.tail)
+	}
+
+	if nn, err := w.w.Write(w.tail[:m]); err != nil {
+		return n + nn, err
+	}
+
+	copy(w.tail[:], w.tail[m:])
+	copy(w.tail[len(w.tail)-m:], p[len(p)-m:])
+
+	nn, err := w.w.Write(p[:len(p)-m])
+
+	return n + nn, err
+}
+
+// compressWriter is a type which compresses the message before
+// passing it to the messageWriter.
+type compressWriter struct {
+	mw   *messageWriter
+	comp *compressor
+	fw   *flate.Writer
+}
+
+func newCompressWriter(mw *messageWriter, comp *compressor) (*compressWriter, error) {
+	fw, err := comp.writer(mw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compressWriter{mw: mw, comp: comp, fw: fw}, nil
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.mw.closed {
+		return 0, errWriterClosed
+	}
+
+	if closeErr := w.mw.conn.getCloseError(); closeErr != nil {
+		return 0, closeErr
+	}
+
+	return w.fw.Write(p)
+}
+
+func (w *compressWriter) Close() error {
+	if w.mw.closed || w.mw.conn.getCloseError() != nil {
+		return w.mw.Close()
+	}
+
+	if err := w.fw.Flush(); err != nil {
+		_ = w.mw.Close()
+
+		return err
+	}
+
+	if tw := w.comp.tw; tw.n != len(tw.tail) || !bytes.Equal(tw.tail[:], []byte(deflateTail[:4])) {
+		_ = w.mw.Close()
+
+		return errCompressionTail
+	}
+
+	return w.mw.Close()
+}
+
+// decompressor is a type which holds the decompression context of the connection.
+type decompressor struct {
+	noContextTakeover bool
+
+	src  deflateSource
+	fr   io.ReadCloser
+	dict []byte
+}
+
+func newDecompressor(noContextTakeover bool) *decompressor {
+	return &decompressor{noContextTakeover: noContextTakeover}
+}
+
+// reset prepares the flate reader to inflate the next message of the connection.
+// The caller must hold readMu.
+func (d *decompressor) reset(conn *Conn) {
+	d.src = deflateSource{conn: conn}
+
+	dict := d.dict
+	if len(dict) > maxWindowSize {
+		dict = dict[len(dict)-maxWindowSize:]
+	}
+
+	if resetter, ok := d.fr.(flate.Resetter); ok {
+		// The flate reader returned by compress/flate never fails to reset.
+		_ = resetter.Reset(&d.src, dict)
+	} else {
+		d.fr = flate.NewReaderDict(&d.src, dict)
+	}
+}
+
+// Read reads the inflated payload of the message. It returns io.EOF at the end of the message.
+func (d *decompressor) Read(p []byte) (int, error) {
+	n, err := d.fr.Read(p)
+	if !d.noContextTakeover {
+		d.remember(p[:n])
+	}
+
+	// The sender may end the message with its own final block (RFC 7692, 7.2.3.), then
+	// the rest of the payload is discarded and the appended tail isn't read.
+	if errors.Is(err, io.EOF) && !d.src.payloadRead {
+		if drainErr := d.src.drain(); drainErr != nil {
+			return n, drainErr
+		}
+	}
+
+	return n, err
+}
+
+// remember appends the inflated bytes to the dictionary of the next message.
+// The dictionary is trimmed to the window size only when it doubles to avoid
+// copying on every read.
+func (d *decompressor) remember(p []byte) {
+	if len(p) > maxWindowSize {
+		p = p[len(p)-maxWindowSize:]
+	}
+
+	d.dict = append(d.dict, p...)
+	if len(d.dict) > 2*maxWindowSize {
+		d.dict = append(d.dict[:0], d.dict[len(d.dict)-maxWindowSize:]...)
+	}
+}
+
+// deflateSource is a type which reads the compressed payload of the message
+// followed by deflateTail. It implements io.ByteReader, so the flate reader
+// doesn't wrap it into the buffered reader.
+type deflateSource struct {
+	conn        *Conn
+	payloadRead bool
+	tail        int
+	buff        [1]byte
+}
+
+func (s *deflateSource) Read(p []byte) (int, error) {
+	if !s.payloadRead {
+		n, err := s.conn.readPayload(p)
+		if !errors.Is(err, io.EOF) {
+			return n, err
+		}
+
+		s.payloadRead = true
+	}
+
+	if s.tail == len(deflateTail) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, deflateTail[s.tail:])
+	s.tail += n
+
+	return n, nil
+}
+
+// drain discards the rest of the compressed payload of the message.
+func (s *deflateSource) drain() error {
+	var buff [512]byte
+
+	for {
+		_, err := s.conn.readPayload(buff[:])
+		if errors.Is(err, io.EOF) {
+			s.payloadRead = true
+
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *deflateSource) ReadByte() (byte, error) {
+	if n, err := s.Read(s.buff[:]); n == 0 {
+		return 0, err
+	}
+
+	return s.buff[0], nil
+}
@@ -0,0 +1,350 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// compressPayload compresses the payload as a single message. If final is true,
+// the message ends with the final deflate block, otherwise the tail of the flushed
+// block is removed (RFC 7692, 7.2.1.).
+func compressPayload(t *testing.T, payload []byte, final bool) []byte {
+	t.Helper()
+
+	var buff bytes.Buffer
+
+	fw, err := flate.NewWriter(&buff, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fw.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if final {
+		err = fw.Close()
+	} else {
+		err = fw.Flush()
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if final {
+		return buff.Bytes()
+	}
+
+	return bytes.TrimSuffix(buff.Bytes(), []byte(deflateTail[:4]))
+}
+
+// TestReadCompressedFinalBlock checks that the message ending with the final deflate
+// block (RFC 7692, 7.2.3.) is accepted and doesn't break the next message.
+func TestReadCompressedFinalBlock(t *testing.T) {
+	clientConn, peer := net.Pipe()
+	client := newConn(clientConn, bufio.NewReadWriter(bufio.NewReader(clientConn), bufio.NewWriter(clientConn)), false)
+	client.enableCompression(deflateParams{})
+
+	t.Cleanup(func() {
+		_ = client.closeNetConn()
+		_ = peer.Close()
+	})
+
+	messages := []struct {
+		payload string
+		final   bool
+	}{
+		{payload: "the message ending with the final block", final: true},
+		{payload: "the message ending with the flushed block", final: false},
+		{payload: "the final block again", final: true},
+	}
+
+	var frames []byte
+
+	for _, msg := range messages {
+		compressed := compressPayload(t, []byte(msg.payload), msg.final)
+		frames = append(frames, 0x80|rsv1Bit|TextOpcode, byte(len(compressed)))
+		frames = append(frames, compressed...)
+	}
+
+	go func() {
+		_, _ = peer.Write(frames)
+	}()
+
+	for _, msg := range messages {
+		_, payload, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(payload) != msg.payload {
+			t.Fatalf("expected %q, got %q", msg.payload, payload)
+		}
+	}
+}
+
+func TestAcceptDeflateOffer(t *testing.T) {
+	deflate := func(params map[string]string) extension {
+		return extension{name: deflateExtensionName, params: params}
+	}
+
+	tests := []struct {
+		name   string
+		offers []extension
+		opts   CompressionOptions
+		want   deflateParams
+		wantOK bool
+	}{
+		{
+			name:   "no offers",
+			offers: nil,
+		},
+		{
+			name:   "unknown extension",
+			offers: []extension{{name: "x-webkit-deflate-frame", params: map[string]string{}}},
+		},
+		{
+			name:   "default offer",
+			offers: []extension{deflate(map[string]string{})},
+			wantOK: true,
+		},
+		{
+			name:   "server options",
+			offers: []extension{deflate(map[string]string{})},
+			opts:   CompressionOptions{ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+			want:   deflateParams{serverNoContextTakeover: true, clientNoContextTakeover: true},
+			wantOK: true,
+		},
+		{
+			name: "no context takeover offered",
+			offers: []extension{deflate(map[string]string{
+				serverNoContextTakeover: "",
+				clientNoContextTakeover: "",
+			})},
+			want:   deflateParams{serverNoContextTakeover: true, clientNoContextTakeover: true},
+			wantOK: true,
+		},
+		{
+			name:   "client window bits hint",
+			offers: []extension{deflate(map[string]string{clientMaxWindowBits: ""})},
+			wantOK: true,
+		},
+		{
+			name:   "client window bits",
+			offers: []extension{deflate(map[string]string{clientMaxWindowBits: "8"})},
+			wantOK: true,
+		},
+		{
+			name:   "invalid client window bits",
+			offers: []extension{deflate(map[string]string{clientMaxWindowBits: "16"})},
+		},
+		{
+			name:   "maximum server window bits",
+			offers: []extension{deflate(map[string]string{serverMaxWindowBits: "15"})},
+			wantOK: true,
+		},
+		{
+			name:   "limited server window bits",
+			offers: []extension{deflate(map[string]string{serverMaxWindowBits: "10"})},
+		},
+		{
+			name: "fallback offer",
+			offers: []extension{
+				deflate(map[string]string{serverMaxWindowBits: "10"}),
+				deflate(map[string]string{clientNoContextTakeover: ""}),
+			},
+			want:   deflateParams{clientNoContextTakeover: true},
+			wantOK: true,
+		},
+		{
+			name:   "param with value",
+			offers: []extension{deflate(map[string]string{serverNoContextTakeover: "1"})},
+		},
+		{
+			name:   "unknown param",
+			offers: []extension{deflate(map[string]string{"mux": ""})},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := acceptDeflateOffer(tt.offers, tt.opts)
+			if ok != tt.wantOK || got != tt.want {
+				t.Fatalf("expected %+v (%t), got %+v (%t)", tt.want, tt.wantOK, got, ok)
+			}
+		})
+	}
+}
+
+func TestAcceptDeflateResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		accepted map[string]string
+		opts     CompressionOptions
+		want     deflateParams
+		wantOK   bool
+	}{
+		{
+			name:     "default response",
+			accepted: map[string]string{},
+			wantOK:   true,
+		},
+		{
+			name:     "client option",
+			accepted: map[string]string{},
+			opts:     CompressionOptions{ClientNoContextTakeover: true},
+			want:     deflateParams{clientNoContextTakeover: true},
+			wantOK:   true,
+		},
+		{
+			name:     "no context takeover",
+			accepted: map[string]string{serverNoContextTakeover: "", clientNoContextTakeover: ""},
+			opts:     CompressionOptions{ServerNoContextTakeover: true},
+			want:     deflateParams{serverNoContextTakeover: true, clientNoContextTakeover: true},
+			wantOK:   true,
+		},
+		{
+			name:     "server no context takeover isn't accepted",
+			accepted: map[string]string{},
+			opts:     CompressionOptions{ServerNoContextTakeover: true},
+		},
+		{
+			name:     "server window bits",
+			accepted: map[string]string{serverMaxWindowBits: "10"},
+			wantOK:   true,
+		},
+		{
+			name:     "server window bits without value",
+			accepted: map[string]string{serverMaxWindowBits: ""},
+		},
+		{
+			name:     "invalid server window bits",
+			accepted: map[string]string{serverMaxWindowBits: "16"},
+		},
+		{
+			name:     "client window bits aren't offered",
+			accepted: map[string]string{clientMaxWindowBits: "15"},
+		},
+		{
+			name:     "param with value",
+			accepted: map[string]string{clientNoContextTakeover: "1"},
+		},
+		{
+			name:     "unknown param",
+			accepted: map[string]string{"mux": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := acceptDeflateResponse(tt.accepted, tt.opts)
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Fatalf("expected %+v (%t), got %+v (%t)", tt.want, tt.wantOK, got, ok)
+			}
+		})
+	}
+}
+
+// TestCompressionRoundTrip checks that the messages compressed with and without
+// context takeover are echoed by the server intact.
+func TestCompressionRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       CompressionOptions
+		extensions string
+	}{
+		{
+			name:       "context takeover",
+			extensions: "permessage-deflate",
+		},
+		{
+			name:       "server no context takeover",
+			opts:       CompressionOptions{ServerNoContextTakeover: true},
+			extensions: "permessage-deflate; server_no_context_takeover",
+		},
+		{
+			name:       "client no context takeover",
+			opts:       CompressionOptions{ClientNoContextTakeover: true},
+			extensions: "permessage-deflate; client_no_context_takeover",
+		},
+		{
+			name:       "no context takeover",
+			opts:       CompressionOptions{ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+			extensions: "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		},
+	}
+
+	messages := [][]byte{
+		[]byte(`{"type":"greeting","text":"hello"}`),
+		[]byte(`{"type":"greeting","text":"hello"}`),
+		bytes.Repeat([]byte(`{"type":"event","seq":12345}`), 4096),
+		{},
+		[]byte(`{"type":"greeting","text":"bye"}`),
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upgrader := &Upgrader{EnableCompression: true, CompressionOptions: tt.opts}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				conn, err := upgrader.Upgrade(w, req, nil)
+				if err != nil {
+					return
+				}
+
+				defer func() { _ = conn.Close() }()
+
+				for {
+					typ, payload, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+
+					if err = conn.WriteMessage(typ, payload); err != nil {
+						return
+					}
+				}
+			}))
+			defer srv.Close()
+
+			dialer := &Dialer{EnableCompression: true, CompressionOptions: tt.opts}
+
+			conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() { _ = conn.Close() }()
+
+			if got := resp.Header.Get("Sec-WebSocket-Extensions"); got != tt.extensions {
+				t.Fatalf("expected extensions %q, got %q", tt.extensions, got)
+			}
+
+			for _, msg := range messages {
+				if err = conn.WriteMessage(TextOpcode, msg); err != nil {
+					t.Fatal(err)
+				}
+
+				_, payload, err := conn.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(payload, msg) {
+					t.Fatalf("expected echo of %d bytes, got %d bytes", len(msg), len(payload))
+				}
+			}
+
+			// The client keeps the dictionary of the server's messages only with context takeover.
+			if keeps := len(conn.decompressor.dict) > 0; keeps == tt.opts.ServerNoContextTakeover {
+				t.Fatalf("unexpected dictionary of %d bytes", len(conn.decompressor.dict))
+			}
+		})
+	}
+}
@@ -2,10 +2,17 @@ package websocket
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
 	"net"
+	"net/http"
+	"sync"
+	"time"
 	"unicode/utf8"
 )
 
@@ -27,6 +34,9 @@ const (
 	CloseTLSHandshake            = 1015
 )
 
+// aLongTimeAgo is a past deadline which makes the blocked I/O operations fail immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
 var validReceivedCloseCodes = map[int]bool{
 	CloseNormalClosure:           true,
 	CloseGoingAway:               true,
@@ -49,15 +59,304 @@ func isValidReceivedCloseCode(code int) bool {
 }
 
 // Conn is a type which represents the WebSocket connection.
+//
+// Conn supports one concurrent reader and multiple concurrent writers. The reading
+// methods (NextReader, ReadMessage and their context variants) and the reads of
+// the returned reader must be called from one goroutine at a time. The writing methods
+// (NextWriter, WriteMessage and their context variants), Close and all the setters are safe
+// to call concurrently. See package documentation for details.
 type Conn struct {
-	conn net.Conn
-	rw   *bufio.ReadWriter
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	isServer bool
+
+	subprotocol string
+	extensions  string
+	request     *http.Request
+	response    *http.Response
+
+	// closed is closed when the network connection is closed,
+	// closeReceived is closed when the peer's close frame is received.
+	closed        chan struct{}
+	closeOnce     sync.Once
+	closeReceived chan struct{}
+
+	// mu protects the fields below which are shared between the reader and writers.
+	mu            sync.Mutex
+	state         int
+	closeErr      *CloseError
+	closeTimeout  time.Duration
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// writeCtxDeadline is the write deadline of the message being written with
+	// the context if writeCtxActive is true. It overrides writeDeadline, so the control
+	// frames written between the frames of the message don't reset it.
+	writeCtxDeadline time.Time
+	writeCtxActive   bool
+	writeCompression bool
+	compressionLevel int
+	readLimit        int64
+	frameReadLimit   int64
+	readBufferPool   BufferPool
+
+	pingHandler  func(appData string) error
+	pongHandler  func(appData string) error
+	closeHandler func(code int, text string) error
+	keepalive    *keepalive
+
+	// writeMu is a channel-based mutex which serializes frames written
+	// to the network connection, the fields below are protected by it.
+	writeMu      chan struct{}
+	writeErr     error
+	closeSent    bool
+	writeHeader  [maxFrameHeaderSize]byte
+	writeControl [maxControlPayloadSize]byte
+	maskKeys     *maskKeyGenerator
+
+	// writeSem serializes data messages. It's acquired by NextWriter
+	// and released when the message writer is closed. The fields below
+	// are protected by it.
+	writeSem        chan struct{}
+	writeBufferSize int
+	writeBufferPool BufferPool
+	writeBuff       []byte
+	compressor      *compressor
+
+	// readMu is a channel-based mutex which is held by the reader. The fields
+	// below are protected by it.
+	readMu       chan struct{}
+	reader       *messageReader
+	readErr      error
+	decompressor *decompressor
+
+	// The state of the data frame being read. The payload is read
+	// directly from the buffered reader by the message reader.
+	readRemaining   int64
+	readFinal       bool
+	readMasked      bool
+	readMaskKey     [4]byte
+	readMaskPos     int
+	readMessageSize int64
+
+	// readHeader and readControl hold the header and the control frame payload
+	// being received, so receiving frames doesn't allocate.
+	readHeader  [8]byte
+	readControl [maxControlPayloadSize]byte
+}
 
-	reader io.Reader
-	writer io.WriteCloser
+func newConn(netConn net.Conn, rw *bufio.ReadWriter, isServer bool) *Conn {
+	c := &Conn{
+		conn:             netConn,
+		rw:               rw,
+		isServer:         isServer,
+		compressionLevel: defaultCompressionLevel,
+		closeTimeout:     defaultCloseTimeout,
+		writeBufferSize:  defaultWriteBufferSize,
+		closed:           make(chan struct{}),
+		closeReceived:    make(chan struct{}),
+		readMu:           make(chan struct{}, 1),
+		writeMu:          make(chan struct{}, 1),
+		writeSem:         make(chan struct{}, 1),
+	}
 
-	closeErr *CloseError
-	isServer bool
+	if !isServer {
+		c.maskKeys = newMaskKeyGenerator(nil)
+	}
+
+	return c
+}
+
+// connOptions is a type which holds the settings of the connection
+// shared by Upgrader and Dialer.
+type connOptions struct {
+	writeBufferSize   int
+	writeBufferPool   BufferPool
+	readBufferPool    BufferPool
+	readLimit         int64
+	frameReadLimit    int64
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+}
+
+// configure applies the options to the connection returned by the handshake.
+func (c *Conn) configure(opts connOptions) {
+	if opts.writeBufferSize > 0 {
+		c.writeBufferSize = opts.writeBufferSize
+	}
+
+	c.writeBufferPool = opts.writeBufferPool
+	c.SetReadBufferPool(opts.readBufferPool)
+	c.SetReadLimit(opts.readLimit)
+	c.SetFrameReadLimit(opts.frameReadLimit)
+
+	if opts.keepaliveInterval > 0 {
+		_ = c.EnableKeepalive(opts.keepaliveInterval, opts.keepaliveTimeout)
+	}
+}
+
+// EnableKeepalive starts pinging the peer every interval. If the pong isn't
+// received within the timeout after the ping, the connection is closed with
+// CloseGoingAway status code and the reading methods return CloseError with
+// CloseAbnormalClosure status code. If the timeout isn't positive, the interval is used.
+//
+// The pongs are processed by the reading methods, so the application must
+// read the connection to keep it alive. The keepalive can't be disabled
+// or reconfigured after it has been enabled.
+func (c *Conn) EnableKeepalive(interval, timeout time.Duration) error {
+	if interval <= 0 {
+		return errInvalidKeepalive
+	}
+
+	if timeout <= 0 {
+		timeout = interval
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keepalive != nil {
+		return errKeepaliveEnabled
+	}
+
+	c.keepalive = newKeepalive(c, interval, timeout)
+	go c.keepalive.run()
+
+	return nil
+}
+
+// RTT returns the round-trip time measured by the last keepalive ping.
+// It returns zero if the keepalive isn't enabled or no pong has been received yet.
+func (c *Conn) RTT() time.Duration {
+	if k := c.getKeepalive(); k != nil {
+		return k.getRTT()
+	}
+
+	return 0
+}
+
+func (c *Conn) getKeepalive() *keepalive {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.keepalive
+}
+
+// Subprotocol returns the subprotocol negotiated in the handshake.
+// It returns an empty string if no subprotocol has been selected.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Extensions returns the extensions negotiated in the handshake in the format
+// of the Sec-WebSocket-Extensions header. It returns an empty string if no extension
+// has been negotiated.
+func (c *Conn) Extensions() string {
+	return c.extensions
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// NetConn returns the underlying network connection. Reading and writing
+// the network connection directly corrupts the WebSocket stream.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// ConnectionState returns the state of the TLS connection. The boolean
+// is false if the underlying network connection isn't a TLS connection.
+func (c *Conn) ConnectionState() (tls.ConnectionState, bool) {
+	conn, ok := c.conn.(interface {
+		ConnectionState() tls.ConnectionState
+	})
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+
+	return conn.ConnectionState(), true
+}
+
+// Request returns the client's handshake request on the server side
+// and nil on the client side. The body of the request mustn't be read.
+func (c *Conn) Request() *http.Request {
+	return c.request
+}
+
+// Response returns the server's handshake response on the client side
+// and nil on the server side. The response has no body.
+func (c *Conn) Response() *http.Response {
+	return c.response
+}
+
+// enableCompression turns on the permessage-deflate extension accepted in the handshake.
+func (c *Conn) enableCompression(params deflateParams) {
+	c.extensions = params.String()
+
+	writeNoContextTakeover, readNoContextTakeover := params.clientNoContextTakeover, params.serverNoContextTakeover
+	if c.isServer {
+		writeNoContextTakeover, readNoContextTakeover = readNoContextTakeover, writeNoContextTakeover
+	}
+
+	c.compressor = newCompressor(writeNoContextTakeover)
+	c.decompressor = newDecompressor(readNoContextTakeover)
+	c.writeCompression = true
+}
+
+// EnableWriteCompression enables and disables compression of the subsequent
+// messages written by the connection. It has no effect if the permessage-deflate
+// extension hasn't been negotiated in the handshake.
+func (c *Conn) EnableWriteCompression(enable bool) {
+	c.mu.Lock()
+	c.writeCompression = enable
+	c.mu.Unlock()
+}
+
+// SetCompressionLevel sets the flate compression level of the subsequent messages.
+// The valid levels are between flate.HuffmanOnly and flate.BestCompression.
+func (c *Conn) SetCompressionLevel(level int) error {
+	if !isValidCompressionLevel(level) {
+		return errInvalidCompressionLevel
+	}
+
+	c.mu.Lock()
+	c.compressionLevel = level
+	c.mu.Unlock()
+
+	return nil
+}
+
+// SetReadLimit sets the maximum size in bytes of the message received from the peer.
+// The size of the compressed message is limited both before and after decompression.
+// If the message exceeds the limit, the reading methods return CloseError with
+// CloseMessageTooBig status code, which is sent to the peer by Close. Zero means no limit.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.mu.Lock()
+	c.readLimit = limit
+	c.mu.Unlock()
+}
+
+// SetFrameReadLimit sets the maximum payload size in bytes of the frame received
+// from the peer. The frame is rejected as soon as its header is received, before the payload
+// is read. If the frame exceeds the limit, the reading methods return CloseError with
+// CloseMessageTooBig status code. Zero means no limit.
+func (c *Conn) SetFrameReadLimit(limit int64) {
+	c.mu.Lock()
+	c.frameReadLimit = limit
+	c.mu.Unlock()
+}
+
+func (c *Conn) getReadLimits() (readLimit, frameReadLimit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.readLimit, c.frameReadLimit
 }
 
 // NextReader returns the message type of the first fragmented frame
@@ -67,40 +366,45 @@ type Conn struct {
 // It discards the previous reader if it's not empty. There can be at most one
 // open reader on a connection.
 func (c *Conn) NextReader() (frameType byte, r io.Reader, err error) {
+	c.readMu <- struct{}{}
+	defer func() { <-c.readMu }()
+
 	if c.reader != nil {
-		_, err = ioutil.ReadAll(c.reader)
-		if err != nil {
+		if err = c.reader.discard(); err != nil {
 			return noFrame, nil, err
 		}
 
 		c.reader = nil
 	}
 
-	for c.closeErr == nil {
+	for c.getCloseError() == nil {
 		fr, err := c.receive()
 		if err != nil {
 			return noFrame, nil, err
 		}
 
 		if fr.isText() || fr.isBinary() {
-			c.reader = newMessageReader(c, fr.opcode, fr.payload, !fr.isFragment)
+			c.reader = newMessageReader(c, fr.opcode, fr.isCompressed())
 
 			return fr.opcode, c.reader, nil
 		}
 	}
 
-	return noFrame, nil, c.closeErr
+	return noFrame, nil, c.getCloseError()
 }
 
 // ReadMessage is a helper method for getting all fragmented frames in one message.
 // It uses NextReader under the hood.
+//
+// If the read buffer pool is set (see SetReadBufferPool), the fragmented and compressed
+// messages are accumulated in the pooled buffer, so the returned payload is allocated once.
 func (c *Conn) ReadMessage() (messageType byte, payload []byte, err error) {
-	frameType, r, err := c.NextReader()
+	frameType, _, err := c.NextReader()
 	if err != nil {
 		return noFrame, nil, err
 	}
 
-	payload, err = ioutil.ReadAll(r)
+	payload, err = c.reader.readAll()
 	if err != nil {
 		return noFrame, nil, err
 	}
@@ -108,95 +412,274 @@ func (c *Conn) ReadMessage() (messageType byte, payload []byte, err error) {
 	return frameType, payload, nil
 }
 
+// SetReadBufferPool sets the pool of the buffers used by ReadMessage to accumulate
+// the payload of the message. The pool may be shared between connections. Nil pool
+// means that the buffers aren't pooled. The pool may be set while the reader is waiting
+// for the message, then it's used starting from that message.
+func (c *Conn) SetReadBufferPool(pool BufferPool) {
+	c.mu.Lock()
+	c.readBufferPool = pool
+	c.mu.Unlock()
+}
+
+func (c *Conn) getReadBufferPool() BufferPool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.readBufferPool
+}
+
+// NextReaderContext is like NextReader, but it aborts waiting for the next message
+// when ctx is done. The context doesn't affect the reads of the returned reader.
+//
+// If ctx is done before the message is received, the underlying connection is closed
+// and the returned error wraps ctx.Err().
+func (c *Conn) NextReaderContext(ctx context.Context) (frameType byte, r io.Reader, err error) {
+	err = c.doContext(ctx, false, func() error {
+		frameType, r, err = c.NextReader()
+
+		return err
+	})
+	if err != nil {
+		return noFrame, nil, err
+	}
+
+	return frameType, r, nil
+}
+
+// ReadMessageContext is like ReadMessage, but it aborts reading when ctx is done.
+//
+// If ctx is done before the message is read, the underlying connection is closed
+// and the returned error wraps ctx.Err().
+func (c *Conn) ReadMessageContext(ctx context.Context) (messageType byte, payload []byte, err error) {
+	err = c.doContext(ctx, false, func() error {
+		messageType, payload, err = c.ReadMessage()
+
+		return err
+	})
+	if err != nil {
+		return noFrame, nil, err
+	}
+
+	return messageType, payload, nil
+}
+
+// receive receives the next frame. The payload of the control frame is read and
+// processed at once, while the payload of the data frame is left in the buffered
+// reader to be read by readPayload. The unread payload of the previous data frame
+// is discarded.
 func (c *Conn) receive() (frame, error) {
-	fr := frame{}
+	if err := c.skipPayload(); err != nil {
+		return frame{}, err
+	}
 
-	head, err := c.read(2)
+	fr, err := c.readFrameHeader()
 	if err != nil {
 		return fr, err
 	}
 
+	if closeErr := c.checkLength(fr); closeErr != nil {
+		return fr, c.setCloseError(closeErr)
+	}
+
+	c.readMasked = fr.isMasked
+	c.readMaskPos = 0
+
+	if fr.isMasked {
+		if err = c.readFull(c.readMaskKey[:]); err != nil {
+			return fr, err
+		}
+	}
+
+	if fr.isControl() {
+		fr.payload = c.readControl[:fr.length]
+		if err = c.readFull(fr.payload); err != nil {
+			return fr, err
+		}
+
+		if fr.isMasked {
+			maskBytes(c.readMaskKey, 0, fr.payload)
+		}
+	}
+
+	if closeErr := c.validate(fr); closeErr != nil {
+		return fr, c.setCloseError(closeErr)
+	}
+
+	if err = c.processReceivedFrame(fr); err != nil {
+		return fr, err
+	}
+
+	if !fr.isControl() {
+		if fr.opcode != ContinuationOpcode {
+			c.readMessageSize = 0
+		}
+
+		c.readMessageSize += int64(fr.length)
+		c.readRemaining = int64(fr.length)
+		c.readFinal = !fr.isFragment
+	}
+
+	return fr, nil
+}
+
+// readFrameHeader reads the first two bytes of the frame header
+// and the extended payload length if any.
+func (c *Conn) readFrameHeader() (frame, error) {
+	fr := frame{}
+
+	head := c.readHeader[:2]
+	if err := c.readFull(head); err != nil {
+		return fr, err
+	}
+
 	fr.isFragment = (head[0] & 0x80) == 0x00
 	fr.reserved = head[0] & 0x70
 	fr.opcode = head[0] & 0x0F
 	fr.isMasked = (head[1] & 0x80) == 0x80
+	fr.length = uint64(head[1] & 0x7F)
 
-	length := uint64(head[1] & 0x7F)
-	switch length {
+	switch fr.length {
 	case 126:
-		lenBytes, err := c.read(2)
-		if err != nil {
+		lenBytes := c.readHeader[:2]
+		if err := c.readFull(lenBytes); err != nil {
 			return fr, err
 		}
 
-		length = uint64(binary.BigEndian.Uint16(lenBytes))
+		fr.length = uint64(binary.BigEndian.Uint16(lenBytes))
 	case 127:
-		lenBytes, err := c.read(8)
-		if err != nil {
+		lenBytes := c.readHeader[:8]
+		if err := c.readFull(lenBytes); err != nil {
 			return fr, err
 		}
 
-		length = binary.BigEndian.Uint64(lenBytes)
+		fr.length = binary.BigEndian.Uint64(lenBytes)
 	}
 
-	fr.length = length
+	return fr, nil
+}
 
-	var maskKey []byte
-	if fr.isMasked {
-		maskKey, err = c.read(4)
-		if err != nil {
-			return fr, err
+// readPayload reads the payload of the current data message into p receiving
+// the continuation frames as needed. It returns io.EOF at the end of the message.
+func (c *Conn) readPayload(p []byte) (int, error) {
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+
+	for c.readRemaining == 0 {
+		if c.readFinal {
+			return 0, io.EOF
 		}
+
+		if err := c.nextContinuationFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > c.readRemaining {
+		p = p[:c.readRemaining]
+	}
+
+	n, err := c.rw.Read(p)
+	if c.readMasked {
+		c.readMaskPos = maskBytes(c.readMaskKey, c.readMaskPos, p[:n])
 	}
 
-	payload, err := c.read(length)
+	c.readRemaining -= int64(n)
+
 	if err != nil {
-		return fr, err
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return n, c.readFailed(err)
 	}
 
-	if fr.isMasked {
-		for i := uint64(0); i < uint64(len(payload)); i++ {
-			payload[i] ^= maskKey[i%4]
+	return n, nil
+}
+
+// nextContinuationFrame receives the next frame of the message skipping control frames.
+func (c *Conn) nextContinuationFrame() error {
+	for c.getCloseError() == nil {
+		fr, err := c.receive()
+		if err != nil {
+			return err
+		}
+
+		if !fr.isControl() {
+			return nil
 		}
 	}
 
-	fr.payload = payload
-	if closeErr := c.validate(fr); closeErr != nil {
-		c.closeErr = closeErr
+	return c.getCloseError()
+}
+
+// skipPayload discards the unread payload of the current data frame.
+func (c *Conn) skipPayload() error {
+	if c.readErr != nil {
+		return c.readErr
+	}
+
+	for c.readRemaining > 0 {
+		n := c.readRemaining
+		if n > math.MaxInt32 {
+			n = math.MaxInt32
+		}
+
+		discarded, err := c.rw.Discard(int(n))
+		c.readRemaining -= int64(discarded)
 
-		return fr, closeErr
+		if err != nil {
+			return c.readFailed(err)
+		}
 	}
 
-	return fr, c.processReceivedFrame(fr)
+	return nil
 }
 
 func (c *Conn) processReceivedFrame(fr frame) error {
 	switch fr.opcode {
 	case CloseOpcode:
-		closeCode := CloseNormalClosure
+		closeErr := &CloseError{Code: CloseNoStatusReceived}
 		if len(fr.payload) >= 2 {
-			closeCode = int(binary.BigEndian.Uint16(fr.payload[:2]))
+			closeErr.Code = int(binary.BigEndian.Uint16(fr.payload[:2]))
+			closeErr.Reason = string(fr.payload[2:])
 		}
 
-		if err := c.close(closeCode); err != nil {
+		c.receiveClose(closeErr)
+
+		if err := c.getCloseHandler()(closeErr.Code, closeErr.Reason); err != nil {
 			return err
 		}
 
-		c.closeErr = &CloseError{code: closeCode}
-
-		return c.closeErr
+		return closeErr
 	case PingOpcode:
-		pongFr := fr
-		pongFr.opcode = PongOpcode
+		if err := c.getPingHandler()(string(fr.payload)); err != nil {
+			return err
+		}
+	case PongOpcode:
+		if k := c.getKeepalive(); k != nil {
+			k.pongReceived(fr.payload)
+		}
 
-		if err := c.send(pongFr); err != nil {
+		if err := c.getPongHandler()(string(fr.payload)); err != nil {
 			return err
 		}
 	case ContinuationOpcode:
+		// The frames of the messages aren't consumed by the application after
+		// the closing handshake has been started, so the sequence isn't checked.
+		if c.getState() != stateOpen {
+			return nil
+		}
+
 		if c.reader == nil {
 			return c.setCloseError(errEmptyContinueFrames)
 		}
 	case TextOpcode, BinaryOpcode:
+		if c.getState() != stateOpen {
+			return nil
+		}
+
 		if c.reader != nil {
 			return c.setCloseError(errInvalidContinuationFrame)
 		}
@@ -205,22 +688,158 @@ func (c *Conn) processReceivedFrame(fr frame) error {
 	return nil
 }
 
-func (c *Conn) read(size uint64) ([]byte, error) {
-	buff := make([]byte, size)
-	if _, err := io.ReadFull(c.rw, buff); err != nil {
-		return nil, err
+// SetPingHandler sets the handler of the ping frames received from the peer.
+// The appData argument is the payload of the ping frame. The default handler
+// replies with the pong frame with the same payload. Passing nil restores
+// the default handler.
+//
+// The handler is called from the reading methods (NextReader, ReadMessage and the
+// Read method of the message reader). The error returned by the handler is returned
+// by the reading method.
+func (c *Conn) SetPingHandler(h func(appData string) error) {
+	c.mu.Lock()
+	c.pingHandler = h
+	c.mu.Unlock()
+}
+
+// SetPongHandler sets the handler of the pong frames received from the peer.
+// The appData argument is the payload of the pong frame. The default handler
+// does nothing. Passing nil restores the default handler.
+//
+// The handler is called from the reading methods like the ping handler.
+func (c *Conn) SetPongHandler(h func(appData string) error) {
+	c.mu.Lock()
+	c.pongHandler = h
+	c.mu.Unlock()
+}
+
+// SetCloseHandler sets the handler of the close frame received from the peer.
+// The code and text arguments are the status code and the reason of the closure.
+// The default handler replies with the close frame with the same status code and
+// closes the network connection. Passing nil restores the default handler.
+//
+// The handler is called from the reading methods like the ping handler. After that
+// the reading method returns CloseError. If the handler doesn't reply to the peer,
+// the application should call Close to complete the closing handshake.
+func (c *Conn) SetCloseHandler(h func(code int, text string) error) {
+	c.mu.Lock()
+	c.closeHandler = h
+	c.mu.Unlock()
+}
+
+func (c *Conn) getPingHandler() func(appData string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pingHandler != nil {
+		return c.pingHandler
+	}
+
+	return c.defaultPingHandler
+}
+
+func (c *Conn) getPongHandler() func(appData string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pongHandler != nil {
+		return c.pongHandler
+	}
+
+	return defaultPongHandler
+}
+
+func (c *Conn) getCloseHandler() func(code int, text string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closeHandler != nil {
+		return c.closeHandler
+	}
+
+	return c.defaultCloseHandler
+}
+
+func (c *Conn) defaultPingHandler(appData string) error {
+	err := c.send(frame{opcode: PongOpcode, payload: []byte(appData)}, nil)
+	if errors.Is(err, errCloseSent) {
+		// The peer's close frame is expected after sending the close frame.
+		return nil
+	}
+
+	return err
+}
+
+func defaultPongHandler(string) error {
+	return nil
+}
+
+func (c *Conn) readFull(p []byte) error {
+	if c.readErr != nil {
+		return c.readErr
+	}
+
+	if _, err := io.ReadFull(c.rw, p); err != nil {
+		return c.readFailed(err)
+	}
+
+	return nil
+}
+
+// readFailed saves the error of the network connection, so the subsequent reads fail.
+func (c *Conn) readFailed(err error) error {
+	// The network connection may be closed because of the closure error.
+	if closeErr := c.getCloseError(); closeErr != nil {
+		err = closeErr
+	}
+
+	c.readErr = err
+
+	return err
+}
+
+// checkLength validates the payload length of the frame before the payload is read.
+func (c *Conn) checkLength(fr frame) *CloseError {
+	// The most significant bit of the 64-bit length must be 0.
+	if fr.length > math.MaxInt64 {
+		return errInvalidFrameLength
+	}
+
+	if fr.isControl() {
+		if fr.length > maxControlPayloadSize {
+			return errInvalidControlFrame
+		}
+
+		return nil
+	}
+
+	readLimit, frameReadLimit := c.getReadLimits()
+	if frameReadLimit > 0 && fr.length > uint64(frameReadLimit) {
+		return errTooBigFrame
+	}
+
+	size := fr.length
+	if fr.opcode == ContinuationOpcode {
+		size += uint64(c.readMessageSize)
+	}
+
+	if readLimit > 0 && size > uint64(readLimit) {
+		return errTooBigMessage
 	}
 
-	return buff, nil
+	return nil
 }
 
 func (c *Conn) validate(fr frame) *CloseError {
-	if fr.isControl() && (fr.length > 125 || fr.isFragment) {
+	if fr.isControl() && fr.isFragment {
 		return errInvalidControlFrame
 	}
 
-	if fr.reserved > 0 {
+	switch {
+	case fr.reserved&^rsv1Bit != 0, fr.isCompressed() && c.decompressor == nil:
 		return errNonZeroRSVFrame
+	case fr.isCompressed() && !fr.isText() && !fr.isBinary():
+		return errInvalidRSV1Frame
 	}
 
 	if fr.opcode > BinaryOpcode && fr.opcode < CloseOpcode || fr.opcode > PongOpcode {
@@ -250,122 +869,590 @@ func (c *Conn) validate(fr frame) *CloseError {
 // NextWriter returns a writer using which you can send message partially.
 // The writer's Close method flushes the complete message to the network.
 //
-// It discards the previous writer if it's not empty. There can be at most one
-// open writer on a connection.
+// There can be at most one open writer on a connection. NextWriter blocks
+// until the previous writer is closed, so the writer must be closed even if
+// writing fails.
 func (c *Conn) NextWriter(messageType byte) (io.WriteCloser, error) {
-	if c.closeErr != nil {
-		return nil, c.closeErr
+	if closeErr := c.getCloseError(); closeErr != nil {
+		return nil, closeErr
+	}
+
+	c.writeSem <- struct{}{}
+
+	w, err := c.newWriter(messageType)
+	if err != nil {
+		<-c.writeSem
+
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// NextWriterContext is like NextWriter, but it aborts waiting for the previous writer
+// to be closed when ctx is done. The Write and Close methods of the returned writer
+// are aborted as well.
+//
+// If ctx is done while waiting for the previous writer, the connection stays open.
+// If ctx is done when the message is being written, the underlying connection is closed,
+// because the message can't be completed. In both cases the returned error wraps ctx.Err().
+// The writer must be closed even if ctx is done.
+func (c *Conn) NextWriterContext(ctx context.Context, messageType byte) (io.WriteCloser, error) {
+	if closeErr := c.getCloseError(); closeErr != nil {
+		return nil, closeErr
+	}
+
+	select {
+	case c.writeSem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("operation is aborted: %w", ctx.Err())
+	}
+
+	w, err := c.newWriter(messageType)
+	if err != nil {
+		<-c.writeSem
+
+		return nil, err
+	}
+
+	return &contextWriter{ctx: ctx, conn: c, w: w}, nil
+}
+
+// newWriter returns a new message writer. The caller must hold writeSem.
+func (c *Conn) newWriter(messageType byte) (io.WriteCloser, error) {
+	compress, level := c.getWriteCompression()
+
+	mw := newMessageWriter(c, messageType)
+	if !compress {
+		return mw, nil
+	}
+
+	mw.compressed = true
+	c.compressor.setLevel(level)
+
+	w, err := newCompressWriter(mw, c.compressor)
+	if err != nil {
+		c.putWriteBuffer(mw.buff)
+
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (c *Conn) getWriteCompression() (compress bool, level int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.compressor != nil && c.writeCompression, c.compressionLevel
+}
+
+// WriteMessage is a helper method to send message entire. The uncompressed
+// message is sent as a single frame.
+func (c *Conn) WriteMessage(messageType byte, payload []byte) error {
+	if closeErr := c.getCloseError(); closeErr != nil {
+		return closeErr
 	}
 
-	if c.writer != nil {
-		err := c.writer.Close()
+	c.writeSem <- struct{}{}
+
+	return c.writeMessage(messageType, payload)
+}
+
+// WriteMessageContext is like WriteMessage, but it aborts writing when ctx is done.
+//
+// If ctx is done while waiting for the previous writer to be closed, the connection
+// stays open. If ctx is done when the message is being written, the underlying
+// connection is closed. In both cases the returned error wraps ctx.Err().
+func (c *Conn) WriteMessageContext(ctx context.Context, messageType byte, payload []byte) error {
+	if closeErr := c.getCloseError(); closeErr != nil {
+		return closeErr
+	}
+
+	select {
+	case c.writeSem <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("operation is aborted: %w", ctx.Err())
+	}
+
+	started := false
+
+	err := c.doContext(ctx, true, func() error {
+		started = true
+
+		return c.writeMessage(messageType, payload)
+	})
+
+	if !started {
+		<-c.writeSem
+	}
+
+	return err
+}
+
+// writeMessage writes the whole message and releases writeSem. The caller must hold writeSem.
+func (c *Conn) writeMessage(messageType byte, payload []byte) error {
+	if compress, _ := c.getWriteCompression(); compress {
+		w, err := c.newWriter(messageType)
 		if err != nil {
-			return nil, err
+			<-c.writeSem
+
+			return err
+		}
+
+		if _, err = w.Write(payload); err != nil {
+			_ = w.Close()
+
+			return err
 		}
 
-		c.writer = nil
+		return w.Close()
 	}
 
-	c.writer = newMessageWriter(c, messageType)
+	defer func() { <-c.writeSem }()
 
-	return c.writer, nil
+	fr := frame{opcode: messageType, payload: payload}
+	if c.isServer {
+		return c.send(fr, nil)
+	}
+
+	// The client copies the payload into the write buffer to mask it.
+	buff := c.getWriteBuffer()
+	defer c.putWriteBuffer(buff)
+
+	return c.send(fr, (*buff)[maxFrameHeaderSize:])
 }
 
-// WriteMessage is a helper method to send message entire.
-// It uses a NextWriter under the hood.
-func (c *Conn) WriteMessage(messageType byte, payload []byte) error {
-	w, err := c.NextWriter(messageType)
-	if err != nil {
+// getWriteBuffer returns the buffer of the message writer, which has maxFrameHeaderSize
+// bytes reserved for the frame header before the payload. The caller must hold writeSem.
+func (c *Conn) getWriteBuffer() *[]byte {
+	size := maxFrameHeaderSize + c.writeBufferSize
+
+	if c.writeBufferPool == nil {
+		if c.writeBuff == nil {
+			c.writeBuff = make([]byte, size)
+		}
+
+		return &c.writeBuff
+	}
+
+	if buff, ok := c.writeBufferPool.Get().(*[]byte); ok && len(*buff) == size {
+		return buff
+	}
+
+	buff := make([]byte, size)
+
+	return &buff
+}
+
+// putWriteBuffer returns the buffer to the pool. The caller must hold writeSem.
+func (c *Conn) putWriteBuffer(buff *[]byte) {
+	if c.writeBufferPool != nil {
+		c.writeBufferPool.Put(buff)
+	}
+}
+
+// runInterruptible runs the I/O operation fn which is interrupted by setting the past
+// deadline with setDeadline when ctx is done. If fn has failed because ctx is done,
+// the context error is returned as ctxErr. hasDeadline reports whether the deadline
+// of ctx is applied to the connection.
+func runInterruptible(
+	ctx context.Context, hasDeadline bool, setDeadline func(t time.Time) error, fn func() error,
+) (err, ctxErr error) {
+	if ctx.Done() == nil {
+		return fn(), nil
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-ctx.Done():
+			_ = setDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	err = fn()
+
+	close(done)
+	<-stopped
+
+	if err == nil {
+		return nil, nil
+	}
+
+	ctxErr = ctx.Err()
+	if ctxErr == nil && hasDeadline && isTimeout(err) {
+		// The deadline of the connection may expire slightly earlier than the context one.
+		ctxErr = context.DeadlineExceeded
+	}
+
+	return err, ctxErr
+}
+
+// doContext runs the I/O operation fn which is interrupted by setting the past
+// deadline when ctx is done. The deadline of ctx is applied if it's earlier than
+// the connection's deadline, which is restored after fn has completed.
+func (c *Conn) doContext(ctx context.Context, write bool, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("operation is aborted: %w", err)
+	}
+
+	setDeadline, restoreDeadline := c.setReadCtxDeadline, c.restoreReadDeadline
+	if write {
+		setDeadline, restoreDeadline = c.setWriteCtxDeadline, c.clearWriteCtxDeadline
+	}
+
+	deadline := c.getDeadline(write)
+
+	ctxDeadline, hasDeadline := ctx.Deadline()
+	hasDeadline = hasDeadline && (deadline.IsZero() || ctxDeadline.Before(deadline))
+
+	if !hasDeadline {
+		ctxDeadline = deadline
+	}
+
+	if err := setDeadline(ctxDeadline); err != nil {
+		_ = restoreDeadline()
+
 		return err
 	}
 
-	_, err = w.Write(payload)
-	if err != nil {
+	err, ctxErr := runInterruptible(ctx, hasDeadline, setDeadline, fn)
+	if ctxErr != nil {
+		_ = c.closeNetConn()
+
+		return fmt.Errorf("operation is aborted: %w", ctxErr)
+	}
+
+	if restoreErr := restoreDeadline(); err == nil {
+		err = restoreErr
+	}
+
+	return err
+}
+
+func (c *Conn) setReadCtxDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) restoreReadDeadline() error {
+	return c.conn.SetReadDeadline(c.getDeadline(false))
+}
+
+// setWriteCtxDeadline sets the write deadline of the message being written with the context.
+func (c *Conn) setWriteCtxDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeCtxDeadline = t
+	c.writeCtxActive = true
+
+	return c.conn.SetWriteDeadline(t)
+}
+
+// clearWriteCtxDeadline restores the application's write deadline after
+// the message has been written with the context.
+func (c *Conn) clearWriteCtxDeadline() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeCtxActive = false
+
+	return c.conn.SetWriteDeadline(c.writeDeadline)
+}
+
+// restoreWriteDeadline sets the write deadline of the network connection to the deadline
+// of the message being written with the context if any or the application's deadline.
+func (c *Conn) restoreWriteDeadline() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn.SetWriteDeadline(c.effectiveWriteDeadline())
+}
+
+// effectiveWriteDeadline returns the current write deadline. The caller must hold mu.
+func (c *Conn) effectiveWriteDeadline() time.Time {
+	if c.writeCtxActive {
+		return c.writeCtxDeadline
+	}
+
+	return c.writeDeadline
+}
+
+func (c *Conn) getDeadline(write bool) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if write {
+		return c.writeDeadline
+	}
+
+	return c.readDeadline
+}
+
+// WriteControl writes the control frame (CloseOpcode, PingOpcode or PongOpcode)
+// with the payload of at most 125 bytes. If the deadline is exceeded while waiting
+// for the frame being written by another goroutine, WriteControl returns net.Error with
+// Timeout method returning true. If the deadline is exceeded while writing the frame,
+// the connection is broken as after any write timeout. A zero deadline means no timeout.
+//
+// WriteControl can be called concurrently with the other writing methods. The control
+// frame is written between the frames of the message being written, if any.
+//
+// Writing the close frame starts the closing handshake: no frames can be written
+// after it. Use Close or CloseWithReason to perform the whole handshake.
+func (c *Conn) WriteControl(opcode byte, payload []byte, deadline time.Time) error {
+	if !isControlOpcode(opcode) {
+		return errInvalidControlOpcode
+	}
+
+	if len(payload) > maxControlPayloadSize {
+		return errTooLongControlPayload
+	}
+
+	var timeout <-chan time.Time
+
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case c.writeMu <- struct{}{}:
+	case <-timeout:
+		return errWriteTimeout
+	}
+
+	defer func() { <-c.writeMu }()
+
+	// The frame is checked before the deadline is set, so writing after the close frame
+	// fails with errCloseSent even if the network connection has already been closed.
+	if err := c.checkWrite(); err != nil {
 		return err
 	}
 
-	return w.Close()
+	if !deadline.IsZero() {
+		if err := c.conn.SetWriteDeadline(deadline); err != nil {
+			return err
+		}
+
+		defer func() { _ = c.restoreWriteDeadline() }()
+	}
+
+	return c.writeFrame(frame{opcode: opcode, payload: payload}, nil)
+}
+
+// WritePing writes the ping frame with the payload. It uses WriteControl
+// without deadline under the hood.
+func (c *Conn) WritePing(payload []byte) error {
+	return c.WriteControl(PingOpcode, payload, time.Time{})
 }
 
-func (c *Conn) send(fr frame) error {
-	data := make([]byte, 2)
+// WritePong writes the unsolicited pong frame with the payload which
+// serves as a unidirectional heartbeat. It uses WriteControl without
+// deadline under the hood.
+func (c *Conn) WritePong(payload []byte) error {
+	return c.WriteControl(PongOpcode, payload, time.Time{})
+}
+
+// send writes the frame to the network connection. See writeFrame for details.
+func (c *Conn) send(fr frame, scratch []byte) error {
+	c.writeMu <- struct{}{}
+	defer func() { <-c.writeMu }()
+
+	return c.writeFrame(fr, scratch)
+}
 
-	data[0] = fr.opcode
-	if !fr.isFragment {
-		data[0] |= 0x80
+// writeFrame writes the frame to the network connection. The masked payload is copied
+// into the scratch buffer chunk by chunk, so the caller's payload is never modified.
+// If scratch is nil, the buffer of the control frames is used. The caller must hold writeMu.
+func (c *Conn) writeFrame(fr frame, scratch []byte) error {
+	if err := c.startFrame(&fr); err != nil {
+		return err
 	}
 
-	length := uint64(len(fr.payload))
+	maskKey, err := c.nextMaskKey(fr)
+	if err != nil {
+		return err
+	}
 
-	switch {
-	case length <= 125:
-		data[1] = byte(length)
-	case length <= 65535:
-		data[1] = 126
+	header := c.writeHeader[:fr.headerSize()]
+	fr.putHeader(header, maskKey)
 
-		lenBytes := make([]byte, 2)
-		binary.BigEndian.PutUint16(lenBytes, uint16(length))
-		data = append(data, lenBytes...)
-	default:
-		data[1] = 127
+	if err := c.write(header); err != nil {
+		return err
+	}
+
+	if !fr.isMasked {
+		if err := c.write(fr.payload); err != nil {
+			return err
+		}
 
-		lenBytes := make([]byte, 8)
-		binary.BigEndian.PutUint64(lenBytes, length)
-		data = append(data, lenBytes...)
+		return c.flush()
 	}
 
-	if !c.isServer {
-		data[1] |= 0x80
+	if scratch == nil {
+		scratch = c.writeControl[:]
+	}
+
+	for pos, payload := 0, fr.payload; len(payload) > 0; {
+		n := copy(scratch, payload)
+		payload = payload[n:]
+		pos = maskBytes(maskKey, pos, scratch[:n])
 
-		maskKey := newMaskKey()
-		for i := 0; i < len(fr.payload); i++ {
-			fr.payload[i] ^= maskKey[i%len(maskKey)]
+		if err := c.write(scratch[:n]); err != nil {
+			return err
 		}
+	}
 
-		data = append(data, maskKey[:]...)
+	return c.flush()
+}
+
+// sendBuffered writes the frame which payload is in buff after maxFrameHeaderSize
+// reserved bytes. The header is written in place before the payload, so the frame
+// is written at once. The payload is masked in place, because buff is owned by the writer.
+func (c *Conn) sendBuffered(fr frame, buff []byte) error {
+	c.writeMu <- struct{}{}
+	defer func() { <-c.writeMu }()
+
+	fr.payload = buff[maxFrameHeaderSize:]
+	if err := c.startFrame(&fr); err != nil {
+		return err
 	}
 
-	data = append(data, fr.payload...)
+	maskKey, err := c.nextMaskKey(fr)
+	if err != nil {
+		return err
+	}
 
-	return c.write(data)
+	if fr.isMasked {
+		maskBytes(maskKey, 0, fr.payload)
+	}
+
+	start := maxFrameHeaderSize - fr.headerSize()
+	fr.putHeader(buff[start:], maskKey)
+
+	if err := c.write(buff[start:]); err != nil {
+		return err
+	}
+
+	return c.flush()
 }
 
-func (c *Conn) write(data []byte) error {
-	if _, err := c.rw.Write(data); err != nil {
+// checkWrite returns the error if the frames can't be written after the write
+// has failed or the close frame has been sent. The caller must hold writeMu.
+func (c *Conn) checkWrite() error {
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+
+	if c.closeSent {
+		return errCloseSent
+	}
+
+	return nil
+}
+
+// startFrame checks whether the frame can be written and completes its header.
+// The caller must hold writeMu.
+func (c *Conn) startFrame(fr *frame) error {
+	if err := c.checkWrite(); err != nil {
 		return err
 	}
 
-	return c.rw.Flush()
+	if fr.isClose() {
+		c.closeSent = true
+		c.setState(stateClosing)
+	}
+
+	fr.isMasked = !c.isServer
+	fr.length = uint64(len(fr.payload))
+
+	return nil
 }
 
-func (c *Conn) setCloseError(err *CloseError) error {
-	c.closeErr = err
+// nextMaskKey returns the masking key of the frame if it's masked. The caller must hold writeMu.
+func (c *Conn) nextMaskKey(fr frame) ([4]byte, error) {
+	if !fr.isMasked {
+		return [4]byte{}, nil
+	}
 
-	return err
+	return c.maskKeys.next()
 }
 
-// Close sends control normal close frame if wasn't any errors. After that
-// the tcp connection will be closed. Otherwise, it sends close frame
-// with status code depending on happened error.
-func (c *Conn) Close() error {
-	if c.closeErr != nil {
-		return c.close(c.closeErr.code)
+func (c *Conn) write(data []byte) error {
+	if _, err := c.rw.Write(data); err != nil {
+		c.writeErr = err
+
+		return err
 	}
 
-	return c.close(CloseNormalClosure)
+	return nil
 }
 
-func (c *Conn) close(statusCode int) error {
-	payload := make([]byte, 2)
-	binary.BigEndian.PutUint16(payload, uint16(statusCode))
+func (c *Conn) flush() error {
+	if err := c.rw.Flush(); err != nil {
+		c.writeErr = err
 
-	fr := frame{
-		opcode:  CloseOpcode,
-		payload: payload,
+		return err
 	}
-	if err := c.send(fr); err != nil {
+
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future reads from the underlying network
+// connection. A zero value for t means reads will not time out. If the deadline is
+// exceeded, the read returns net.Error with Timeout method returning true.
+//
+// After a read has failed, the stream position is undefined, so the connection
+// is broken and all subsequent reads return the same error.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for future writes to the underlying network
+// connection. A zero value for t means writes will not time out. If the deadline is
+// exceeded, the write returns net.Error with Timeout method returning true.
+//
+// After a write has failed, the frame may have been written partially, so the connection
+// is broken: all subsequent writes return the same error and no more frames are sent.
+// The application should call Close to release the connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+
+	return c.conn.SetWriteDeadline(c.effectiveWriteDeadline())
+}
+
+// SetDeadline sets both read and write deadlines of the connection.
+// See SetReadDeadline and SetWriteDeadline for details.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.writeDeadline = t
+
+	if err := c.conn.SetReadDeadline(t); err != nil {
 		return err
 	}
 
-	return c.conn.Close()
+	return c.conn.SetWriteDeadline(c.effectiveWriteDeadline())
 }
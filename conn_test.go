@@ -0,0 +1,320 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newPipeConns returns the client and server connections communicating over net.Pipe.
+func newPipeConns(t *testing.T, writeBufferSize int) (client, server *Conn) {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+
+	client = newConn(clientConn, bufio.NewReadWriter(bufio.NewReader(clientConn), bufio.NewWriter(clientConn)), false)
+	server = newConn(serverConn, bufio.NewReadWriter(bufio.NewReader(serverConn), bufio.NewWriter(serverConn)), true)
+	client.writeBufferSize = writeBufferSize
+	server.writeBufferSize = writeBufferSize
+
+	t.Cleanup(func() {
+		_ = client.closeNetConn()
+		_ = server.closeNetConn()
+	})
+
+	return client, server
+}
+
+// readUntilError reads the messages until the error, which is returned.
+func readUntilError(conn *Conn, check func(payload []byte) error) error {
+	for {
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		if check != nil {
+			if err = check(payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writePings pings the peer until the error.
+func writePings(conn *Conn) {
+	for i := 0; ; i++ {
+		if err := conn.WritePing([]byte(fmt.Sprintf("ping-%d", i))); err != nil {
+			return
+		}
+	}
+}
+
+func checkPong(appData string) error {
+	if !strings.HasPrefix(appData, "ping-") {
+		return fmt.Errorf("corrupted pong %q", appData)
+	}
+
+	return nil
+}
+
+// TestConcurrentWriters checks that the frames of the messages written concurrently
+// and the pong and close replies sent by the reading goroutine are never interleaved.
+func TestConcurrentWriters(t *testing.T) {
+	const (
+		writers      = 4
+		messages     = 100
+		chunkSize    = 50
+		chunks       = 3
+		messageSize  = 200
+		receivedStop = writers * messages / 2
+	)
+
+	client, server := newPipeConns(t, 64)
+
+	var pongs int32
+
+	server.SetPongHandler(func(appData string) error {
+		atomic.AddInt32(&pongs, 1)
+
+		return checkPong(appData)
+	})
+
+	var (
+		mu       sync.Mutex
+		received int
+		enough   = make(chan struct{})
+	)
+
+	checkMessage := func(payload []byte) error {
+		if len(payload) != chunkSize*chunks && len(payload) != messageSize {
+			return fmt.Errorf("unexpected message size %d", len(payload))
+		}
+
+		if len(bytes.Trim(payload, string(payload[:1]))) != 0 {
+			return fmt.Errorf("message frames are interleaved: %q", payload)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if received++; received == receivedStop {
+			close(enough)
+		}
+
+		return nil
+	}
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 2)
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		errs <- readUntilError(server, checkMessage)
+	}()
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		errs <- readUntilError(client, nil)
+	}()
+
+	// Only the server pings: the reading goroutines of both sides writing the pongs
+	// to the unbuffered pipe at the same time would block each other.
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		writePings(server)
+	}()
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+
+		go func(b byte) {
+			defer wg.Done()
+
+			writeMessages(client, b, messages, bytes.Repeat([]byte{b}, chunkSize), chunks, messageSize)
+		}(byte('a' + i))
+	}
+
+	<-enough
+
+	if err := server.CloseWithReason(CloseNormalClosure, "bye"); err != nil {
+		t.Errorf("close: %v", err)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	if atomic.LoadInt32(&pongs) == 0 {
+		t.Error("no pongs received")
+	}
+
+	for err := range errs {
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != CloseNormalClosure {
+			t.Errorf("expected normal closure, got %v", err)
+		}
+	}
+}
+
+// writeMessages writes the fragmented messages using NextWriter and
+// the single frame messages using WriteMessage in turn until the error.
+func writeMessages(conn *Conn, b byte, n int, chunk []byte, chunks, messageSize int) {
+	for i := 0; i < n; i++ {
+		if i%2 == 1 {
+			if err := conn.WriteMessage(BinaryOpcode, bytes.Repeat([]byte{b}, messageSize)); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		w, err := conn.NextWriter(BinaryOpcode)
+		if err != nil {
+			return
+		}
+
+		for j := 0; j < chunks; j++ {
+			if _, err = w.Write(chunk); err != nil {
+				break
+			}
+		}
+
+		if err = w.Close(); err != nil {
+			return
+		}
+	}
+}
+
+// deadlineConn is the network connection which records its write deadline.
+type deadlineConn struct {
+	net.Conn
+
+	mu            sync.Mutex
+	writeDeadline time.Time
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *deadlineConn) getWriteDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.writeDeadline
+}
+
+// TestWriteContextDeadlineAfterControlFrame checks that the control frame written
+// while the message is being written with the context doesn't reset the context deadline.
+func TestWriteContextDeadlineAfterControlFrame(t *testing.T) {
+	serverConn, peer := net.Pipe()
+	netConn := &deadlineConn{Conn: serverConn}
+	server := newConn(netConn, bufio.NewReadWriter(bufio.NewReader(netConn), bufio.NewWriter(netConn)), true)
+
+	t.Cleanup(func() {
+		_ = server.closeNetConn()
+		_ = peer.Close()
+	})
+
+	go func() {
+		_, _ = io.Copy(io.Discard, peer)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	ctxDeadline, _ := ctx.Deadline()
+
+	err := server.doContext(ctx, true, func() error {
+		if err := server.WriteControl(PingOpcode, nil, time.Now().Add(time.Hour)); err != nil {
+			return err
+		}
+
+		if deadline := netConn.getWriteDeadline(); !deadline.Equal(ctxDeadline) {
+			return fmt.Errorf("write deadline %v isn't restored to the context deadline %v", deadline, ctxDeadline)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deadline := netConn.getWriteDeadline(); !deadline.IsZero() {
+		t.Fatalf("write deadline %v isn't restored after writing", deadline)
+	}
+}
+
+func TestNextWriterContext(t *testing.T) {
+	client, server := newPipeConns(t, 16)
+
+	go func() {
+		_ = readUntilError(server, nil)
+	}()
+
+	w, err := client.NextWriter(TextOpcode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The previous writer isn't closed, so waiting is aborted and the connection stays open.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err = client.NextWriterContext(ctx, TextOpcode); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error, got %v", err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+
+	cw, err := client.NextWriterContext(ctx, BinaryOpcode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = cw.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The message can't be completed after ctx is done, so the connection is closed.
+	cancel()
+
+	if _, err = cw.Write(make([]byte, 100)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+
+	if err = cw.Close(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+
+	if err = client.WriteMessage(TextOpcode, nil); err == nil {
+		t.Fatal("expected error writing to the closed connection")
+	}
+}
@@ -3,11 +3,16 @@
 // Usage
 //
 // The Conn type represents the WebSocket connection. if you are developing a server
-// application you should use Upgrade function in your http handler to switching protocol
+// application you should use Upgrader.Upgrade method in your http handler to switching protocol
 // to WebSocket.
 //
+//  var upgrader = &websocket.Upgrader{
+//      ReadBufferSize:  1024,
+//      WriteBufferSize: 1024,
+//  }
+//
 //  func handler(w http.ResponseWriter, req *http.Request) {
-//      conn, err := websocket.Upgrade(w, req)
+//      conn, err := upgrader.Upgrade(w, req, nil)
 //      if err != nil {
 //          log.Println(err)
 //          return
@@ -15,6 +20,8 @@
 //      ...
 //  }
 //
+// The Upgrade function is a shortcut which uses the Upgrader with default settings.
+//
 // Otherwise, if you are interesting to use websocket package as a client you should
 // invoke Dialer.Dial at first (or Dialer.DialContext). For example:
 //
@@ -22,7 +29,7 @@
 //     dialer := &websocket.Dialer{
 //         HandshakeTimeout: 10 * time.Second,
 //     }
-//     conn, err := dialer.Dial("ws://localhost:8080")
+//     conn, _, err := dialer.Dial("ws://localhost:8080", nil)
 //     if err != nil {
 //         log.Fatal(err)
 //     }
@@ -43,4 +50,53 @@
 //  }
 //
 // Also you can use Conn.NextWriter and Conn.NextReader for fragmented sending and receiving.
+//
+// Concurrency
+//
+// Connections support one concurrent reader and multiple concurrent writers.
+//
+// The application must call the reading methods (NextReader, ReadMessage and their context
+// variants) and the Read method of the returned reader from one goroutine at a time.
+//
+// The writing methods (NextWriter, WriteMessage and their context variants) can be called
+// concurrently. The messages are never interleaved: NextWriter blocks until the previously
+// returned writer is closed. The control frames sent by the reading methods in reply to
+// the peer (pong and close frames) are written between the frames of the messages.
+// The same applies to the control frames written by the application using
+// WriteControl, WritePing and WritePong.
+//
+// Close, the deadline setters and the compression setters are safe to call concurrently
+// with all other methods.
+//
+// Keepalive
+//
+// Use Conn.EnableKeepalive (or KeepaliveInterval field of Dialer and Upgrader) to detect
+// dead peers. The connection pings the peer at the interval and closes the connection if
+// the pong isn't received in time. The round-trip time of the last ping is returned by Conn.RTT.
+//
+// Compression
+//
+// The package supports the permessage-deflate extension defined in RFC 7692. The client
+// offers it if Dialer.EnableCompression is true, the server accepts the client's offer if
+// Upgrader.EnableCompression is true.
+// If the extension is negotiated, messages are compressed by default. Use
+// Conn.EnableWriteCompression and Conn.SetCompressionLevel to control the compression
+// of the subsequent messages.
+//
+// Buffers
+//
+// The reading methods read the payload directly from the connection's buffered reader
+// into the application's buffer. The message writer accumulates the payload in its
+// buffer (see Upgrader.WriteBufferSize) and sends it as the frame when the buffer is full,
+// while the chunk which exceeds the buffer is sent as the frame without copying.
+// WriteMessage sends the uncompressed message as a single frame. The buffers may be
+// drawn from the pools shared between connections (see BufferPool).
+//
+// Closing
+//
+// Conn.Close and Conn.CloseWithReason perform the closing handshake: they send the close
+// frame, wait for the peer's close frame at most the close timeout (see Conn.SetCloseTimeout)
+// and close the network connection. When the peer starts the closing handshake, the reading
+// methods reply with the close frame and return *CloseError with the peer's status code
+// and reason. The close frame is never sent twice.
 package websocket
@@ -1,21 +1,61 @@
 package websocket
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// HandshakeReason is a type which represents the machine-readable reason of the handshake failure.
+type HandshakeReason string
+
+// Reasons of the handshake failure.
+const (
+	// HandshakeBadRequest means that the client's request isn't a valid upgrade request.
+	HandshakeBadRequest HandshakeReason = "bad_request"
+	// HandshakeForbiddenOrigin means that the origin of the client's request isn't allowed.
+	HandshakeForbiddenOrigin HandshakeReason = "forbidden_origin"
+	// HandshakeReservedHeader means that the application has set the header
+	// which is negotiated by the package itself.
+	HandshakeReservedHeader HandshakeReason = "reserved_header"
+	// HandshakeInternalError means that the server failed to take over the connection.
+	HandshakeInternalError HandshakeReason = "internal_error"
+	// HandshakeBadStatus means that the server responded with the status other than 101.
+	HandshakeBadStatus HandshakeReason = "bad_status"
+	// HandshakeBadResponse means that the server's 101 response isn't valid.
+	HandshakeBadResponse HandshakeReason = "bad_response"
+)
 
 // HandshakeError is a type which represents an error occurs
 // in process handshake to establish WebSocket connection.
 type HandshakeError struct {
-	reason string
+	// Reason is the machine-readable reason of the failure.
+	Reason HandshakeReason
+	// StatusCode is the HTTP status code of the response sent by the server
+	// or received by the client. It's zero if there is no response.
+	StatusCode int
+
+	text string
+}
+
+func newHandshakeError(reason HandshakeReason, statusCode int, text string) HandshakeError {
+	return HandshakeError{Reason: reason, StatusCode: statusCode, text: text}
 }
 
 func (e HandshakeError) Error() string {
-	return e.reason
+	return e.text
 }
 
+var errInvalidExtensions = newHandshakeError(
+	HandshakeBadResponse, http.StatusSwitchingProtocols, "invalid Sec-WebSocket-Extensions header value",
+)
+
 // CloseError is a type which represents closure WebSocket error.
 type CloseError struct {
-	code int
-	text string
+	// Code is the status code of the closure.
+	Code int
+	// Reason is the text describing the reason of the closure.
+	Reason string
 }
 
 func newCloseError(code int, text string) *CloseError {
@@ -23,7 +63,7 @@ func newCloseError(code int, text string) *CloseError {
 }
 
 func (e *CloseError) Error() string {
-	return fmt.Sprintf("%d: %s", e.code, e.text)
+	return fmt.Sprintf("%d: %s", e.Code, e.Reason)
 }
 
 var (
@@ -35,6 +75,10 @@ var (
 		CloseProtocolError,
 		"reserved bits must be set at 0, when no extension defining RSV meaning has been negotiated",
 	)
+	errInvalidRSV1Frame = newCloseError(
+		CloseProtocolError,
+		"RSV1 bit may be set only at the first frame of the compressed data message",
+	)
 	errReservedOpcodeFrame = newCloseError(
 		CloseProtocolError,
 		"opcodes 0x03-0x07 and 0xB-0xF are reserved for further frames",
@@ -47,6 +91,18 @@ var (
 		CloseProtocolError,
 		"there is no frames to continue",
 	)
+	errInvalidFrameLength = newCloseError(
+		CloseProtocolError,
+		"the most significant bit of the payload length must be 0",
+	)
+	errTooBigFrame = newCloseError(
+		CloseMessageTooBig,
+		"frame payload exceeds the read limit",
+	)
+	errTooBigMessage = newCloseError(
+		CloseMessageTooBig,
+		"message exceeds the read limit",
+	)
 	errInvalidClosurePayload = newCloseError(
 		CloseProtocolError,
 		"invalid close payload",
@@ -59,4 +115,42 @@ var (
 		CloseInvalidFramePayloadData,
 		"invalid UTF-8 text payload",
 	)
+	errInvalidCompressedPayload = newCloseError(
+		CloseInvalidFramePayloadData,
+		"invalid compressed payload",
+	)
+	errKeepaliveTimeout = newCloseError(
+		CloseAbnormalClosure,
+		"pong wasn't received in time",
+	)
 )
+
+var (
+	errInvalidControlOpcode    = errors.New("invalid control frame opcode")
+	errTooLongControlPayload   = errors.New("control frame payload must be 125 bytes or less")
+	errWriterClosed            = errors.New("write to the closed message writer")
+	errCloseSent               = errors.New("close frame has already been sent")
+	errInvalidCloseCode        = errors.New("invalid close status code")
+	errTooLongCloseReason      = errors.New("close reason must be 123 bytes or less")
+	errInvalidCloseReason      = errors.New("close reason must be valid UTF-8 text")
+	errCompressionTail         = errors.New("unexpected tail of the compressed message")
+	errInvalidCompressionLevel = errors.New("invalid compression level")
+	errInvalidKeepalive        = errors.New("keepalive interval must be positive")
+	errKeepaliveEnabled        = errors.New("keepalive is already enabled")
+	errProxyDataAfterConnect   = errors.New("proxy sent unexpected data after the CONNECT response")
+	errSocksBadVersion         = errors.New("SOCKS5 proxy replied with unexpected protocol version")
+	errSocksNoAuthMethod       = errors.New("SOCKS5 proxy didn't accept any offered authentication method")
+	errSocksBadCredentials     = errors.New("SOCKS5 username and password must be 1-255 and 0-255 bytes long")
+	errSocksAuthFailed         = errors.New("SOCKS5 proxy rejected the username and password")
+	errSocksBadAuthVersion     = errors.New("SOCKS5 proxy replied with unexpected authentication version")
+)
+
+// timeoutError is a type which represents net.Error occurred
+// when the deadline is exceeded before the I/O operation has been started.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errWriteTimeout error = timeoutError{}
@@ -7,8 +7,12 @@ import (
 	"github.com/Mort4lis/websocket"
 )
 
+var upgrader = &websocket.Upgrader{
+	EnableCompression: true,
+}
+
 func initWebsocket(w http.ResponseWriter, req *http.Request) {
-	conn, err := websocket.Upgrade(w, req)
+	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
 		return
 	}
@@ -13,7 +13,7 @@ func main() {
 		HandshakeTimeout: 10 * time.Second,
 	}
 
-	conn, err := dialer.Dial("ws://127.0.0.1:8080")
+	conn, _, err := dialer.Dial("ws://127.0.0.1:8080", nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1,5 +1,7 @@
 package websocket
 
+import "encoding/binary"
+
 // Type of frames which defines in RFC 6455.
 const (
 	ContinuationOpcode = 0x00
@@ -12,6 +14,16 @@ const (
 	noFrame = 0xff
 )
 
+// maxControlPayloadSize is the maximum payload length of the control frames.
+const maxControlPayloadSize = 125
+
+// maxFrameHeaderSize is the maximum size of the frame header: two bytes,
+// 64-bit extended payload length and the masking key.
+const maxFrameHeaderSize = 2 + 8 + 4
+
+// rsv1Bit is the RSV1 bit of the first frame byte which marks the compressed message (RFC 7692).
+const rsv1Bit = 0x40
+
 type frame struct {
 	isFragment bool
 	reserved   byte
@@ -33,6 +45,60 @@ func (f frame) isClose() bool {
 	return f.opcode == CloseOpcode
 }
 
+func (f frame) isCompressed() bool {
+	return f.reserved&rsv1Bit != 0
+}
+
 func (f frame) isControl() bool {
-	return f.opcode == CloseOpcode || f.opcode == PingOpcode || f.opcode == PongOpcode
+	return isControlOpcode(f.opcode)
+}
+
+// headerSize returns the size of the frame header.
+func (f frame) headerSize() int {
+	size := 2
+
+	switch {
+	case f.length > 65535:
+		size += 8
+	case f.length > 125:
+		size += 2
+	}
+
+	if f.isMasked {
+		size += 4
+	}
+
+	return size
+}
+
+// putHeader writes the frame header into b, which must have at least headerSize bytes.
+func (f frame) putHeader(b []byte, maskKey [4]byte) {
+	b[0] = f.opcode | f.reserved
+	if !f.isFragment {
+		b[0] |= 0x80
+	}
+
+	n := 2
+
+	switch {
+	case f.length > 65535:
+		b[1] = 127
+		binary.BigEndian.PutUint64(b[2:], f.length)
+		n += 8
+	case f.length > 125:
+		b[1] = 126
+		binary.BigEndian.PutUint16(b[2:], uint16(f.length))
+		n += 2
+	default:
+		b[1] = byte(f.length)
+	}
+
+	if f.isMasked {
+		b[1] |= 0x80
+		copy(b[n:], maskKey[:])
+	}
+}
+
+func isControlOpcode(opcode byte) bool {
+	return opcode == CloseOpcode || opcode == PingOpcode || opcode == PongOpcode
 }
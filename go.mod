@@ -1,3 +1,3 @@
 module github.com/Mort4lis/websocket
 
-go 1.16
+go 1.17
@@ -0,0 +1,111 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// keepalive is a type which pings the peer at the interval and closes
+// the connection if the pong isn't received in time.
+type keepalive struct {
+	conn     *Conn
+	interval time.Duration
+	timeout  time.Duration
+
+	pong chan struct{}
+
+	mu         sync.Mutex
+	pingSentAt time.Time
+	pingData   []byte
+	rtt        time.Duration
+}
+
+func newKeepalive(conn *Conn, interval, timeout time.Duration) *keepalive {
+	return &keepalive{
+		conn:     conn,
+		interval: interval,
+		timeout:  timeout,
+		pong:     make(chan struct{}, 1),
+	}
+}
+
+func (k *keepalive) run() {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-k.conn.closed:
+			return
+		}
+
+		// The ping isn't written in time if the peer doesn't read the connection,
+		// which is the dead peer as well.
+		sentAt := time.Now()
+		if err := k.conn.WriteControl(PingOpcode, k.newPing(sentAt), sentAt.Add(k.timeout)); err != nil {
+			if !errors.Is(err, errCloseSent) && k.conn.getState() == stateOpen {
+				k.conn.closeAbnormally(CloseGoingAway, errKeepaliveTimeout)
+			}
+
+			return
+		}
+
+		timer := time.NewTimer(k.timeout)
+
+		select {
+		case <-k.pong:
+			timer.Stop()
+		case <-timer.C:
+			k.conn.closeAbnormally(CloseGoingAway, errKeepaliveTimeout)
+
+			return
+		case <-k.conn.closed:
+			timer.Stop()
+
+			return
+		}
+	}
+}
+
+// newPing returns the payload of the next ping. The payload is the time
+// when the ping is sent, so it's unique for every ping.
+func (k *keepalive) newPing(sentAt time.Time) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(sentAt.UnixNano()))
+
+	k.mu.Lock()
+	k.pingSentAt = sentAt
+	k.pingData = data
+	k.mu.Unlock()
+
+	return data
+}
+
+// pongReceived measures the round-trip time if the pong replies to the last ping.
+func (k *keepalive) pongReceived(data []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.pingData == nil || !bytes.Equal(k.pingData, data) {
+		return
+	}
+
+	k.rtt = time.Since(k.pingSentAt)
+	k.pingData = nil
+
+	select {
+	case k.pong <- struct{}{}:
+	default:
+	}
+}
+
+func (k *keepalive) getRTT() time.Duration {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.rtt
+}
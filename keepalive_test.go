@@ -0,0 +1,34 @@
+package websocket
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestKeepaliveBlockedPing checks that the connection is closed if the ping
+// can't be written because the peer doesn't read the connection.
+func TestKeepaliveBlockedPing(t *testing.T) {
+	client, _ := newPipeConns(t, defaultWriteBufferSize)
+
+	if err := client.EnableKeepalive(20*time.Millisecond, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+
+	go func() {
+		_, _, err := client.ReadMessage()
+		errs <- err
+	}()
+
+	select {
+	case err := <-errs:
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != CloseAbnormalClosure {
+			t.Fatalf("expected abnormal closure, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader isn't unblocked after the ping write has failed")
+	}
+}
@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// maskWordSize is the number of bytes masked at once by maskBytes.
+	maskWordSize = 8
+	// maskKeyBatchSize is the number of the masking keys read from the source at once.
+	maskKeyBatchSize = 64
+)
+
+// maskKeyGenerator is a type which generates the masking keys of the client's frames.
+// The keys must be unpredictable (RFC 6455, 10.3), so they are read from the
+// crypto-strength source in batches to keep the key generation cheap per frame.
+type maskKeyGenerator struct {
+	src  io.Reader
+	pos  int
+	keys [4 * maskKeyBatchSize]byte
+}
+
+// newMaskKeyGenerator returns the generator reading the keys from src.
+// If src is nil, crypto/rand.Reader is used.
+func newMaskKeyGenerator(src io.Reader) *maskKeyGenerator {
+	if src == nil {
+		src = rand.Reader
+	}
+
+	g := &maskKeyGenerator{src: src}
+	g.pos = len(g.keys)
+
+	return g
+}
+
+func (g *maskKeyGenerator) next() ([4]byte, error) {
+	var key [4]byte
+
+	if g.pos == len(g.keys) {
+		if _, err := io.ReadFull(g.src, g.keys[:]); err != nil {
+			return key, err
+		}
+
+		g.pos = 0
+	}
+
+	g.pos += copy(key[:], g.keys[g.pos:])
+
+	return key, nil
+}
+
+// maskBytes masks (or unmasks) b with the key starting from the pos byte
+// of the key. It returns the key position following the last masked byte,
+// so the payload can be masked in chunks.
+//
+// The payload is masked by 8-byte words using the key rotated to pos and repeated
+// twice. The words are loaded and stored with encoding/binary, which the compiler
+// turns into single memory operations, so no unsafe code is needed.
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	pos &= 3
+
+	if len(b) >= maskWordSize {
+		var word [maskWordSize]byte
+		for i := range word {
+			word[i] = key[(pos+i)&3]
+		}
+
+		keyWord := binary.LittleEndian.Uint64(word[:])
+
+		// The length of the masked part is a multiple of the key length,
+		// so the key position doesn't change.
+		n := len(b) &^ (maskWordSize - 1)
+		for i := 0; i < n; i += maskWordSize {
+			chunk := b[i : i+maskWordSize : i+maskWordSize]
+			binary.LittleEndian.PutUint64(chunk, binary.LittleEndian.Uint64(chunk)^keyWord)
+		}
+
+		b = b[n:]
+	}
+
+	for i := range b {
+		b[i] ^= key[pos]
+		pos = (pos + 1) & 3
+	}
+
+	return pos
+}
@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// maskBytesLoop is the byte-by-byte masking which maskBytes replaces.
+func maskBytesLoop(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[pos%4]
+		pos++
+	}
+
+	return pos % 4
+}
+
+func TestMaskBytes(t *testing.T) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+
+	payload := make([]byte, 100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	for pos := 0; pos < 4; pos++ {
+		for size := 0; size <= len(payload); size++ {
+			for split := 0; split <= size; split += 3 {
+				want := append([]byte(nil), payload[:size]...)
+				wantPos := maskBytesLoop(key, pos, want)
+
+				got := append([]byte(nil), payload[:size]...)
+				gotPos := maskBytes(key, maskBytes(key, pos, got[:split]), got[split:])
+
+				if !bytes.Equal(got, want) || gotPos != wantPos {
+					t.Fatalf("pos %d, size %d, split %d: got %x (pos %d), want %x (pos %d)",
+						pos, size, split, got, gotPos, want, wantPos)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkMaskBytes(b *testing.B) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+
+	for _, size := range []int{15, 128, 4096, 65536} {
+		payload := make([]byte, size)
+
+		b.Run(fmt.Sprintf("words/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+
+			for i := 0; i < b.N; i++ {
+				maskBytes(key, 1, payload)
+			}
+		})
+
+		b.Run(fmt.Sprintf("loop/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+
+			for i := 0; i < b.N; i++ {
+				maskBytesLoop(key, 1, payload)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+package websocket
+
+// BufferPool is an interface of the pool of the buffers used by connections,
+// e.g. *sync.Pool. The pool may be shared between connections, but the values
+// put into the pool by the package must not be mixed with the other values.
+type BufferPool interface {
+	// Get returns the buffer from the pool or nil if the pool is empty.
+	Get() interface{}
+	// Put adds the buffer to the pool.
+	Put(interface{})
+}
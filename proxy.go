@@ -0,0 +1,285 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// defaultSocksPort is the port of the SOCKS5 proxy if the proxy URL doesn't specify it.
+const defaultSocksPort = "1080"
+
+// The constants of the SOCKS5 protocol defined in RFC 1928 and RFC 1929.
+const (
+	socksVersion = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthUserPassword = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksUserPasswordVersion = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded = 0x00
+)
+
+// proxyHostPort returns the host:port address of the proxy. The supported proxy
+// schemes are http, socks5 and socks5h.
+func proxyHostPort(proxyURL *url.URL) (string, error) {
+	var port string
+
+	switch proxyURL.Scheme {
+	case "http":
+		port = "80"
+	case "socks5", "socks5h":
+		port = defaultSocksPort
+	default:
+		return "", fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+
+	if proxyURL.Port() != "" {
+		port = proxyURL.Port()
+	}
+
+	return net.JoinHostPort(proxyURL.Hostname(), port), nil
+}
+
+// connectProxy establishes the tunnel to the target host:port address through
+// the proxy connection. The user info of the proxy URL is used for the proxy authentication.
+func connectProxy(netConn net.Conn, proxyURL *url.URL, hostPort string) error {
+	if proxyURL.Scheme == "http" {
+		return httpConnect(netConn, proxyURL, hostPort)
+	}
+
+	return socksConnect(netConn, proxyURL, hostPort)
+}
+
+// httpConnect establishes the tunnel to the target host:port address
+// sending the CONNECT request to the HTTP proxy.
+func httpConnect(netConn net.Conn, proxyURL *url.URL, hostPort string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: hostPort},
+		Host:   hostPort,
+		Header: make(http.Header),
+	}
+
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(netConn); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(netConn)
+
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return err
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy responded with status %q to CONNECT request", resp.Status)
+	}
+
+	// The server doesn't send anything through the tunnel before the handshake,
+	// so the buffered data means the proxy's response is malformed.
+	if r.Buffered() > 0 {
+		return errProxyDataAfterConnect
+	}
+
+	return nil
+}
+
+// socksConnect establishes the tunnel to the target host:port address
+// through the SOCKS5 proxy (RFC 1928). The host name is resolved by the proxy.
+func socksConnect(netConn net.Conn, proxyURL *url.URL, hostPort string) error {
+	if err := socksAuthenticate(netConn, proxyURL.User); err != nil {
+		return err
+	}
+
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q of the target address", portStr)
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0x00}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("target host name %q is too long for SOCKS5 proxy", host)
+		}
+
+		req = append(req, socksAddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+
+	if _, err = netConn.Write(req); err != nil {
+		return err
+	}
+
+	return readSocksReply(netConn)
+}
+
+// socksAuthenticate negotiates the authentication method with the SOCKS5 proxy.
+// If the user info is set, the username/password authentication (RFC 1929) is offered.
+func socksAuthenticate(netConn net.Conn, user *url.Userinfo) error {
+	greeting := []byte{socksVersion, 1, socksAuthNone}
+	if user != nil {
+		greeting = []byte{socksVersion, 2, socksAuthNone, socksAuthUserPassword}
+	}
+
+	if _, err := netConn.Write(greeting); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(netConn, resp[:]); err != nil {
+		return err
+	}
+
+	if resp[0] != socksVersion {
+		return errSocksBadVersion
+	}
+
+	switch resp[1] {
+	case socksAuthNone:
+		return nil
+	case socksAuthUserPassword:
+		if user != nil {
+			return socksUserPassword(netConn, user)
+		}
+	case socksAuthNoAcceptable:
+		return errSocksNoAuthMethod
+	}
+
+	return fmt.Errorf("SOCKS5 proxy selected unsupported authentication method %d", resp[1])
+}
+
+// socksUserPassword performs the username/password authentication defined in RFC 1929.
+func socksUserPassword(netConn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+
+	if len(username) == 0 || len(username) > 255 || len(password) > 255 {
+		return errSocksBadCredentials
+	}
+
+	req := make([]byte, 0, 3+len(username)+len(password))
+	req = append(req, socksUserPasswordVersion, byte(len(username)))
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+
+	if _, err := netConn.Write(req); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(netConn, resp[:]); err != nil {
+		return err
+	}
+
+	if resp[0] != socksUserPasswordVersion {
+		return errSocksBadAuthVersion
+	}
+
+	if resp[1] != 0x00 {
+		return errSocksAuthFailed
+	}
+
+	return nil
+}
+
+// readSocksReply reads the proxy's reply to the CONNECT request.
+func readSocksReply(netConn net.Conn) error {
+	var header [4]byte
+	if _, err := io.ReadFull(netConn, header[:]); err != nil {
+		return err
+	}
+
+	if header[0] != socksVersion {
+		return errSocksBadVersion
+	}
+
+	if header[1] != socksReplySucceeded {
+		return fmt.Errorf("SOCKS5 proxy failed to connect to the target: %s", socksReplyText(header[1]))
+	}
+
+	var addrLen int
+
+	switch header[3] {
+	case socksAddrIPv4:
+		addrLen = net.IPv4len
+	case socksAddrIPv6:
+		addrLen = net.IPv6len
+	case socksAddrDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(netConn, size[:]); err != nil {
+			return err
+		}
+
+		addrLen = int(size[0])
+	default:
+		return fmt.Errorf("SOCKS5 proxy replied with unknown address type %d", header[3])
+	}
+
+	// The bound address and port aren't used.
+	bound := make([]byte, addrLen+2)
+	_, err := io.ReadFull(netConn, bound)
+
+	return err
+}
+
+func socksReplyText(code byte) string {
+	switch code {
+	case 0x01:
+		return "general server failure"
+	case 0x02:
+		return "connection not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	case 0x07:
+		return "command not supported"
+	case 0x08:
+		return "address type not supported"
+	}
+
+	return "unknown reply code " + strconv.Itoa(int(code))
+}
@@ -0,0 +1,464 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newEchoServer starts the WebSocket server which echoes the received messages.
+func newEchoServer(t *testing.T, useTLS bool) *httptest.Server {
+	t.Helper()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := (&Upgrader{}).Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+
+		defer func() { _ = conn.Close() }()
+
+		for {
+			typ, payload, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			if err = conn.WriteMessage(typ, payload); err != nil {
+				return
+			}
+		}
+	})
+
+	srv := httptest.NewUnstartedServer(handler)
+	if useTLS {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// wsURL returns the WebSocket URL of the test server.
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// checkEcho checks that the message written to the connection is echoed back.
+func checkEcho(t *testing.T, conn *Conn) {
+	t.Helper()
+
+	if err := conn.WriteMessage(TextOpcode, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, payload, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(payload) != "hello" {
+		t.Fatalf("expected echo %q, got %q", "hello", payload)
+	}
+}
+
+// startProxy starts the proxy which serves every accepted connection. It returns
+// the address of the proxy.
+func startProxy(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go serve(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// tunnel copies the bytes between the connections until either of them is closed.
+func tunnel(conn, target net.Conn) {
+	go func() {
+		_, _ = io.Copy(target, conn)
+		_ = target.Close()
+	}()
+
+	_, _ = io.Copy(conn, target)
+	_ = conn.Close()
+}
+
+// serveHTTPConnect returns the HTTP proxy which responds to the CONNECT request
+// with the status and passes the Proxy-Authorization header of the request to auth.
+func serveHTTPConnect(status int, auth chan<- string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		defer func() { _ = conn.Close() }()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+
+		auth <- req.Header.Get("Proxy-Authorization")
+
+		if status != http.StatusOK {
+			_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+
+			return
+		}
+
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			return
+		}
+
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+		tunnel(conn, target)
+	}
+}
+
+func TestDialHTTPProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     *url.Userinfo
+		status   int
+		wantAuth string
+		wantErr  string
+	}{
+		{
+			name:   "no auth",
+			status: http.StatusOK,
+		},
+		{
+			name:     "basic auth",
+			user:     url.UserPassword("user", "secret"),
+			status:   http.StatusOK,
+			wantAuth: "Basic dXNlcjpzZWNyZXQ=",
+		},
+		{
+			name:     "rejected",
+			user:     url.User("user"),
+			status:   http.StatusProxyAuthRequired,
+			wantAuth: "Basic dXNlcjo=",
+			wantErr:  "407 Proxy Authentication Required",
+		},
+	}
+
+	srv := newEchoServer(t, false)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := make(chan string, 1)
+			proxyURL := &url.URL{Scheme: "http", User: tt.user, Host: startProxy(t, serveHTTPConnect(tt.status, auth))}
+			dialer := &Dialer{Proxy: http.ProxyURL(proxyURL)}
+
+			conn, _, err := dialer.Dial(wsURL(srv), nil)
+			if got := <-auth; got != tt.wantAuth {
+				t.Fatalf("expected proxy authorization %q, got %q", tt.wantAuth, got)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() { _ = conn.Close() }()
+
+			checkEcho(t, conn)
+		})
+	}
+}
+
+// socksProxy is the SOCKS5 proxy which requires the username/password authentication
+// if the username is set. It replies to the CONNECT request with the reply code.
+type socksProxy struct {
+	username    string
+	password    string
+	authVersion byte
+	reply       byte
+}
+
+func (p *socksProxy) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	if !p.authenticate(conn) {
+		return
+	}
+
+	addr, err := readSocksConnect(conn)
+	if err != nil {
+		return
+	}
+
+	reply := []byte{socksVersion, p.reply, 0x00, socksAddrIPv4, 127, 0, 0, 1, 0, 0}
+	if p.reply != socksReplySucceeded {
+		_, _ = conn.Write(reply)
+
+		return
+	}
+
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	if _, err = conn.Write(reply); err != nil {
+		_ = target.Close()
+
+		return
+	}
+
+	tunnel(conn, target)
+}
+
+func (p *socksProxy) authenticate(conn net.Conn) bool {
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return false
+	}
+
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return false
+	}
+
+	method := byte(socksAuthNone)
+	if p.username != "" {
+		method = socksAuthUserPassword
+	}
+
+	if bytes.IndexByte(methods, method) < 0 {
+		_, _ = conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+
+		return false
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return false
+	}
+
+	if method == socksAuthNone {
+		return true
+	}
+
+	username, password, err := readSocksUserPassword(conn)
+	if err != nil {
+		return false
+	}
+
+	version, status := p.authVersion, byte(0x00)
+	if version == 0 {
+		version = socksUserPasswordVersion
+	}
+
+	if username != p.username || password != p.password {
+		status = 0x01
+	}
+
+	_, err = conn.Write([]byte{version, status})
+
+	return err == nil && status == 0x00
+}
+
+func readSocksUserPassword(r io.Reader) (username, password string, err error) {
+	readString := func() (string, error) {
+		var size [1]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "", err
+		}
+
+		b := make([]byte, size[0])
+		_, err := io.ReadFull(r, b)
+
+		return string(b), err
+	}
+
+	var version [1]byte
+	if _, err = io.ReadFull(r, version[:]); err != nil {
+		return "", "", err
+	}
+
+	if username, err = readString(); err != nil {
+		return "", "", err
+	}
+
+	password, err = readString()
+
+	return username, password, err
+}
+
+// readSocksConnect reads the CONNECT request and returns the target address.
+func readSocksConnect(r io.Reader) (string, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", err
+	}
+
+	var host []byte
+
+	switch header[3] {
+	case socksAddrIPv4:
+		host = make([]byte, net.IPv4len)
+	case socksAddrIPv6:
+		host = make([]byte, net.IPv6len)
+	case socksAddrDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "", err
+		}
+
+		host = make([]byte, size[0])
+	default:
+		return "", fmt.Errorf("unknown address type %d", header[3])
+	}
+
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+
+	hostStr := string(host)
+	if header[3] != socksAddrDomain {
+		hostStr = net.IP(host).String()
+	}
+
+	return net.JoinHostPort(hostStr, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func TestDialSocksProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxy   socksProxy
+		user    *url.Userinfo
+		wantErr string
+	}{
+		{
+			name: "no auth",
+		},
+		{
+			name:  "username and password",
+			proxy: socksProxy{username: "user", password: "secret"},
+			user:  url.UserPassword("user", "secret"),
+		},
+		{
+			name:    "no acceptable method",
+			proxy:   socksProxy{username: "user", password: "secret"},
+			wantErr: errSocksNoAuthMethod.Error(),
+		},
+		{
+			name:    "wrong password",
+			proxy:   socksProxy{username: "user", password: "secret"},
+			user:    url.UserPassword("user", "wrong"),
+			wantErr: errSocksAuthFailed.Error(),
+		},
+		{
+			name:    "wrong authentication version",
+			proxy:   socksProxy{username: "user", password: "secret", authVersion: socksVersion},
+			user:    url.UserPassword("user", "secret"),
+			wantErr: errSocksBadAuthVersion.Error(),
+		},
+		{
+			name:    "failure reply",
+			proxy:   socksProxy{reply: 0x05},
+			wantErr: "connection refused",
+		},
+	}
+
+	srv := newEchoServer(t, false)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyURL := &url.URL{Scheme: "socks5", User: tt.user, Host: startProxy(t, tt.proxy.serve)}
+			dialer := &Dialer{Proxy: http.ProxyURL(proxyURL)}
+
+			conn, _, err := dialer.Dial(wsURL(srv), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() { _ = conn.Close() }()
+
+			checkEcho(t, conn)
+		})
+	}
+}
+
+// TestDialProxyTLS checks that the TLS handshake with the server is performed
+// over the tunnel.
+func TestDialProxyTLS(t *testing.T) {
+	srv := newEchoServer(t, true)
+	auth := make(chan string, 1)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	proxies := map[string]func(conn net.Conn){
+		"http":   serveHTTPConnect(http.StatusOK, auth),
+		"socks5": (&socksProxy{}).serve,
+	}
+
+	for scheme, serve := range proxies {
+		t.Run(scheme, func(t *testing.T) {
+			proxyURL := &url.URL{Scheme: scheme, Host: startProxy(t, serve)}
+			dialer := &Dialer{TLSConfig: &tls.Config{RootCAs: roots}, Proxy: http.ProxyURL(proxyURL)}
+
+			conn, resp, err := dialer.Dial(wsURL(srv), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() { _ = conn.Close() }()
+
+			if resp.TLS == nil {
+				t.Fatal("expected TLS connection state of the response")
+			}
+
+			checkEcho(t, conn)
+		})
+	}
+}
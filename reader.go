@@ -1,63 +1,192 @@
 package websocket
 
 import (
+	"bytes"
+	"errors"
 	"io"
-	"unicode/utf8"
+	"io/ioutil"
 )
 
+// maxPayloadPrealloc is the maximum size of the payload which is allocated
+// in advance by ReadMessage if neither read limit is set. The larger payloads
+// are read into the growing buffer, so the frame header declaring a huge length
+// can't make the reader allocate the memory which the peer never sends.
+const maxPayloadPrealloc = 64 << 10
+
 type messageReader struct {
 	conn        *Conn
 	messageType byte
-	isLast      bool
-	pos         int
-	buff        []byte
+	compressed  bool
+	eof         bool
+
+	// size is the number of bytes read by the application.
+	size int64
+	// sizeHint is the size of the message if it's known in advance.
+	sizeHint int64
+	utf8     utf8Validator
 }
 
-func newMessageReader(conn *Conn, messageType byte, buff []byte, isLast bool) *messageReader {
-	return &messageReader{
+// newMessageReader returns the reader of the message which first frame has been
+// just received. The caller must hold readMu.
+func newMessageReader(conn *Conn, messageType byte, compressed bool) *messageReader {
+	r := &messageReader{
 		conn:        conn,
 		messageType: messageType,
-		isLast:      isLast,
-		buff:        buff,
+		compressed:  compressed,
+		sizeHint:    -1,
+	}
+
+	if compressed {
+		conn.decompressor.reset(conn)
+	} else if conn.readFinal {
+		r.sizeHint = conn.readRemaining
 	}
+
+	return r
 }
 
 func (r *messageReader) Read(p []byte) (int, error) {
-	if r.isEOF() {
+	r.conn.readMu <- struct{}{}
+	defer func() { <-r.conn.readMu }()
+
+	return r.read(p)
+}
+
+// read reads the payload of the message directly into p. The caller must hold readMu.
+func (r *messageReader) read(p []byte) (int, error) {
+	if r.eof || r.conn.reader != r {
 		return 0, io.EOF
 	}
 
-	if !r.isLast && len(r.buff[r.pos:]) < len(p) {
-		var (
-			fr  frame
-			err error
-		)
+	if closeErr := r.conn.getCloseError(); closeErr != nil {
+		return 0, closeErr
+	}
 
-		for r.conn.closeErr == nil {
-			fr, err = r.conn.receive()
-			if err != nil {
-				return 0, err
-			}
+	var (
+		n   int
+		err error
+	)
 
-			if !fr.isControl() {
-				break
-			}
+	if r.compressed {
+		n, err = r.conn.decompressor.Read(p)
+	} else {
+		n, err = r.conn.readPayload(p)
+	}
+
+	r.size += int64(n)
+
+	if errors.Is(err, io.EOF) {
+		r.eof = true
+	} else if err != nil {
+		return n, r.readFailed(err)
+	}
+
+	if closeErr := r.check(p[:n]); closeErr != nil {
+		return 0, r.conn.setCloseError(closeErr)
+	}
+
+	return n, err
+}
+
+// readFailed maps the decompression errors to the closure errors.
+func (r *messageReader) readFailed(err error) error {
+	var closeErr *CloseError
+	if !r.compressed || errors.As(err, &closeErr) || r.conn.readErr != nil {
+		return err
+	}
+
+	return r.conn.setCloseError(errInvalidCompressedPayload)
+}
+
+// check validates the next chunk of the payload p.
+func (r *messageReader) check(p []byte) *CloseError {
+	if r.compressed {
+		if readLimit, _ := r.conn.getReadLimits(); readLimit > 0 && r.size > readLimit {
+			return errTooBigMessage
+		}
+	}
+
+	if r.messageType == TextOpcode && (!r.utf8.write(p) || r.eof && !r.utf8.done()) {
+		return errInvalidUtf8Payload
+	}
+
+	return nil
+}
+
+// readAll reads the whole message. It's used by ReadMessage.
+func (r *messageReader) readAll() ([]byte, error) {
+	if r.canPrealloc() {
+		payload := make([]byte, r.sizeHint)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+
+		// Read the end of the message to validate it.
+		if _, err := r.Read(nil); !errors.Is(err, io.EOF) {
+			return nil, err
 		}
 
-		r.isLast = !fr.isFragment
-		r.buff = append(r.buff, fr.payload...)
+		return payload, nil
+	}
+
+	pool := r.conn.getReadBufferPool()
+	if pool == nil {
+		return ioutil.ReadAll(r)
+	}
+
+	buff, ok := pool.Get().(*bytes.Buffer)
+	if !ok {
+		buff = &bytes.Buffer{}
+	}
+
+	defer func() {
+		buff.Reset()
+		pool.Put(buff)
+	}()
+
+	if _, err := buff.ReadFrom(r); err != nil {
+		return nil, err
 	}
 
-	if r.isLast && r.messageType == TextOpcode && !utf8.Valid(r.buff) {
-		return 0, r.conn.setCloseError(errInvalidUtf8Payload)
+	return append([]byte(nil), buff.Bytes()...), nil
+}
+
+// canPrealloc reports whether the payload of the known size can be allocated at once.
+// The frame exceeding the limits is rejected when its header is received, so the size
+// is bounded by the configured limit if any.
+func (r *messageReader) canPrealloc() bool {
+	if r.sizeHint < 0 {
+		return false
 	}
 
-	n := copy(p, r.buff[r.pos:])
-	r.pos += n
+	readLimit, frameReadLimit := r.conn.getReadLimits()
 
-	return n, nil
+	return r.sizeHint <= maxPayloadPrealloc || readLimit > 0 || frameReadLimit > 0
 }
 
-func (r *messageReader) isEOF() bool {
-	return r.conn.closeErr != nil || r.conn.reader != r || (r.isLast && len(r.buff[r.pos:]) == 0)
+// discard reads the rest of the message. The caller must hold readMu.
+func (r *messageReader) discard() error {
+	if !r.compressed && r.messageType != TextOpcode {
+		for !r.conn.readFinal {
+			if err := r.conn.nextContinuationFrame(); err != nil {
+				return err
+			}
+		}
+
+		return r.conn.skipPayload()
+	}
+
+	// The compressed message is decompressed to keep the compression
+	// context, the text is validated.
+	var buff [512]byte
+
+	for {
+		if _, err := r.read(buff[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+	}
 }
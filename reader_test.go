@@ -0,0 +1,66 @@
+package websocket
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestReadMessageHugeFrameLength checks that ReadMessage doesn't allocate
+// the payload of the length declared by the frame header in advance.
+func TestReadMessageHugeFrameLength(t *testing.T) {
+	clientConn, peer := net.Pipe()
+	defer func() { _ = peer.Close() }()
+
+	client := newConn(clientConn, bufio.NewReadWriter(bufio.NewReader(clientConn), bufio.NewWriter(clientConn)), false)
+	defer func() { _ = client.closeNetConn() }()
+
+	go func() {
+		_, _ = peer.Write([]byte{0x82, 0x7f, 0x40, 0, 0, 0, 0, 0, 0, 0})
+		_, _ = peer.Write([]byte("payload"))
+		_ = peer.Close()
+	}()
+
+	if _, _, err := client.ReadMessage(); err == nil {
+		t.Fatal("expected error reading the truncated frame")
+	}
+}
+
+// TestSetReadBufferPoolWhileReading checks that setting the read buffer pool
+// doesn't wait for the reader waiting for the message.
+func TestSetReadBufferPoolWhileReading(t *testing.T) {
+	client, server := newPipeConns(t, defaultWriteBufferSize)
+
+	payloads := make(chan []byte, 1)
+
+	go func() {
+		_, payload, _ := client.ReadMessage()
+		payloads <- payload
+	}()
+
+	// Give the reader time to start waiting for the message.
+	time.Sleep(10 * time.Millisecond)
+
+	set := make(chan struct{})
+
+	go func() {
+		client.SetReadBufferPool(&sync.Pool{})
+		close(set)
+	}()
+
+	select {
+	case <-set:
+	case <-time.After(time.Second):
+		t.Fatal("SetReadBufferPool is blocked by the reader")
+	}
+
+	if err := server.WriteMessage(TextOpcode, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload := <-payloads; string(payload) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", payload)
+	}
+}
@@ -0,0 +1,117 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// credentialHeaders are the canonical keys of the request headers which aren't
+// sent to the other host or over the plain connection after the redirect.
+var credentialHeaders = []string{
+	"Authorization",
+	"Cookie",
+}
+
+// redirectLocation returns the Location header of the redirect response
+// if the Dialer follows redirects.
+func (d *Dialer) redirectLocation(resp *http.Response) (string, bool) {
+	if d.MaxRedirects <= 0 || resp == nil {
+		return "", false
+	}
+
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return "", false
+	}
+
+	location := resp.Header.Get("Location")
+
+	return location, location != ""
+}
+
+// checkRedirect returns the error if the request redirected via the previous
+// requests mustn't be sent.
+func (d *Dialer) checkRedirect(req *http.Request, via []*http.Request, resp *http.Response) error {
+	if len(via) == 0 {
+		return nil
+	}
+
+	if len(via) > d.MaxRedirects {
+		return newHandshakeError(
+			HandshakeBadStatus, resp.StatusCode, fmt.Sprintf("stopped after %d redirects", d.MaxRedirects),
+		)
+	}
+
+	if d.CheckRedirect != nil {
+		return d.CheckRedirect(req, via)
+	}
+
+	return nil
+}
+
+// redirectEndpoint returns the endpoint and the request header of the handshake
+// redirected from the request to the location.
+func (d *Dialer) redirectEndpoint(
+	ep *Endpoint, req *http.Request, location string, requestHeader http.Header,
+) (*Endpoint, http.Header, error) {
+	locURL, err := url.Parse(location)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid redirect location %q: %w", location, err)
+	}
+
+	next := req.URL.ResolveReference(locURL)
+
+	switch next.Scheme {
+	case "ws":
+		next.Scheme = "http"
+	case "wss":
+		next.Scheme = "https"
+	case "http", "https":
+	default:
+		return nil, nil, fmt.Errorf("unsupported redirect location scheme %q", next.Scheme)
+	}
+
+	// The credentials aren't sent to the other host or over the plain connection
+	// redirected from the secure one.
+	keepCredentials := strings.EqualFold(next.Hostname(), req.URL.Hostname()) &&
+		(req.URL.Scheme != "https" || next.Scheme == "https")
+
+	header := make(http.Header, len(requestHeader))
+
+	for key, values := range requestHeader {
+		key = http.CanonicalHeaderKey(key)
+
+		// The overridden Host header is kept only for the relative location.
+		if key == "Host" && locURL.IsAbs() {
+			continue
+		}
+
+		if containsString(credentialHeaders, key) && !keepCredentials {
+			continue
+		}
+
+		header[key] = values
+	}
+
+	if next.Scheme == ep.URL.Scheme && strings.EqualFold(next.Host, ep.URL.Host) {
+		return &Endpoint{Network: ep.Network, Addr: ep.Addr, URL: next}, header, nil
+	}
+
+	wsURL := *next
+	wsURL.Scheme = "ws"
+
+	if next.Scheme == "https" {
+		wsURL.Scheme = "wss"
+	}
+
+	nextEp, err := d.resolveEndpoint(&wsURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nextEp, header, nil
+}
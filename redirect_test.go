@@ -0,0 +1,224 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newRedirectServer starts the server which redirects every request to the location
+// with 302 status. The requests are counted in requests if it isn't nil.
+func newRedirectServer(t *testing.T, useTLS bool, location string, requests *int32) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if requests != nil {
+			atomic.AddInt32(requests, 1)
+		}
+
+		http.Redirect(w, req, location, http.StatusFound)
+	}))
+
+	if useTLS {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// newHeaderServer starts the WebSocket server which passes the header
+// of the handshake request to the returned channel.
+func newHeaderServer(t *testing.T) (*httptest.Server, <-chan http.Header) {
+	t.Helper()
+
+	headers := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		headers <- req.Header.Clone()
+
+		if conn, err := (&Upgrader{}).Upgrade(w, req, nil); err == nil {
+			_ = conn.closeNetConn()
+		}
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return srv, headers
+}
+
+func TestRedirectLimit(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRedirects int
+		wantRequests int32
+		wantErr      string
+	}{
+		{
+			name:         "redirects aren't followed",
+			maxRedirects: 0,
+			wantRequests: 1,
+			wantErr:      "302",
+		},
+		{
+			name:         "redirect loop",
+			maxRedirects: 3,
+			wantRequests: 4,
+			wantErr:      "stopped after 3 redirects",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+
+			srv := newRedirectServer(t, false, "/loop", &requests)
+			dialer := &Dialer{MaxRedirects: tt.maxRedirects}
+
+			_, resp, err := dialer.Dial(wsURL(srv)+"/loop", nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+			}
+
+			if resp == nil || resp.StatusCode != http.StatusFound {
+				t.Fatalf("expected redirect response, got %v", resp)
+			}
+
+			if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+				t.Fatalf("expected %d requests, got %d", tt.wantRequests, got)
+			}
+		})
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	echoSrv := newEchoServer(t, false)
+	srv := newRedirectServer(t, false, echoSrv.URL+"/echo", nil)
+	errStop := errors.New("stop")
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr error
+	}{
+		{
+			name: "followed",
+		},
+		{
+			name:    "stopped",
+			err:     errStop,
+			wantErr: errStop,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var via []*http.Request
+
+			dialer := &Dialer{
+				MaxRedirects: 1,
+				CheckRedirect: func(req *http.Request, reqVia []*http.Request) error {
+					if req.URL.Path != "/echo" {
+						t.Errorf("unexpected redirected request to %s", req.URL)
+					}
+
+					via = reqVia
+
+					return tt.err
+				},
+			}
+
+			conn, resp, err := dialer.Dial(wsURL(srv)+"/start", nil)
+			if len(via) != 1 || via[0].URL.Path != "/start" {
+				t.Fatalf("unexpected previous requests %v", via)
+			}
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) || resp == nil || resp.StatusCode != http.StatusFound {
+					t.Fatalf("expected error %v with redirect response, got %v", tt.wantErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() { _ = conn.Close() }()
+
+			checkEcho(t, conn)
+		})
+	}
+}
+
+func TestRedirectCredentialHeaders(t *testing.T) {
+	target, headers := newHeaderServer(t)
+	otherHost := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name            string
+		useTLS          bool
+		location        string
+		keepCredentials bool
+	}{
+		{
+			name:            "same host",
+			location:        target.URL,
+			keepCredentials: true,
+		},
+		{
+			name:     "other host",
+			location: otherHost,
+		},
+		{
+			name:     "https to http",
+			useTLS:   true,
+			location: target.URL,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newRedirectServer(t, tt.useTLS, tt.location, nil)
+
+			dialer := &Dialer{MaxRedirects: 1}
+			if tt.useTLS {
+				roots := x509.NewCertPool()
+				roots.AddCert(srv.Certificate())
+				dialer.TLSConfig = &tls.Config{RootCAs: roots}
+			}
+
+			requestHeader := http.Header{
+				"Authorization": {"Bearer token"},
+				"Cookie":        {"session=secret"},
+				"X-Request-Id":  {"42"},
+			}
+
+			conn, _, err := dialer.Dial(wsURL(srv), requestHeader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_ = conn.closeNetConn()
+
+			header := <-headers
+			if header.Get("X-Request-Id") != "42" {
+				t.Fatal("X-Request-Id header isn't redirected")
+			}
+
+			for _, key := range credentialHeaders {
+				if kept := header.Get(key) != ""; kept != tt.keepCredentials {
+					t.Fatalf("%s header is kept: %t", key, kept)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package websocket
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Endpoint is a type which represents the server's endpoint resolved from the dialed URL.
+type Endpoint struct {
+	// Network and Addr specify the network address of the server, e.g. "tcp" and
+	// "example.com:443" or "unix" and "/run/app.sock". Only the tcp endpoints
+	// are dialed through the proxy.
+	Network string
+	Addr    string
+
+	// URL is the http or https URL of the handshake request. Its path and query are
+	// the request target, its host is sent in the Host header. The https scheme makes
+	// the client perform the TLS handshake.
+	URL *url.URL
+}
+
+// SchemeResolver is a function which resolves the dialed URL to the server's endpoint.
+type SchemeResolver func(u *url.URL) (*Endpoint, error)
+
+// defaultSchemeResolvers are the resolvers of the URL schemes supported out of the box.
+var defaultSchemeResolvers = map[string]SchemeResolver{
+	"ws":       resolveTCPEndpoint,
+	"wss":      resolveTCPEndpoint,
+	"ws+unix":  resolveUnixEndpoint,
+	"wss+unix": resolveUnixEndpoint,
+}
+
+// resolveEndpoint resolves the URL to the endpoint using the resolvers
+// of the Dialer or the default ones.
+func (d *Dialer) resolveEndpoint(u *url.URL) (*Endpoint, error) {
+	resolve, ok := d.SchemeResolvers[u.Scheme]
+	if !ok {
+		resolve, ok = defaultSchemeResolvers[u.Scheme]
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+
+	ep, err := resolve(u)
+	if err != nil {
+		return nil, err
+	}
+
+	if ep.URL == nil || (ep.URL.Scheme != "http" && ep.URL.Scheme != "https") {
+		return nil, fmt.Errorf("%s scheme resolver returned endpoint without http or https URL", u.Scheme)
+	}
+
+	return ep, nil
+}
+
+// resolveTCPEndpoint resolves the ws and wss URLs. The default ports are 80 and 443.
+func resolveTCPEndpoint(u *url.URL) (*Endpoint, error) {
+	httpURL := *u
+	httpURL.Scheme = httpScheme(u.Scheme)
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if httpURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	return &Endpoint{
+		Network: "tcp",
+		Addr:    net.JoinHostPort(u.Hostname(), port),
+		URL:     &httpURL,
+	}, nil
+}
+
+// resolveUnixEndpoint resolves the ws+unix and wss+unix URLs. The path of the URL is
+// the socket path optionally followed by the colon and the request path, e.g.
+// ws+unix:///run/app.sock:/chat?room=1. The URL host is sent in the Host header,
+// it's localhost if the URL host is empty.
+func resolveUnixEndpoint(u *url.URL) (*Endpoint, error) {
+	socketPath, requestPath := u.Path, "/"
+	if i := strings.IndexByte(u.Path, ':'); i >= 0 {
+		socketPath, requestPath = u.Path[:i], u.Path[i+1:]
+	}
+
+	if socketPath == "" {
+		return nil, fmt.Errorf("url %q doesn't specify the socket path", u)
+	}
+
+	if !strings.HasPrefix(requestPath, "/") {
+		requestPath = "/" + requestPath
+	}
+
+	host := u.Host
+	if host == "" {
+		host = "localhost"
+	}
+
+	return &Endpoint{
+		Network: "unix",
+		Addr:    socketPath,
+		URL: &url.URL{
+			Scheme:   httpScheme(strings.TrimSuffix(u.Scheme, "+unix")),
+			Host:     host,
+			Path:     requestPath,
+			RawQuery: u.RawQuery,
+		},
+	}, nil
+}
+
+// httpScheme maps the ws and wss schemes to http and https.
+func httpScheme(scheme string) string {
+	if scheme == "wss" {
+		return "https"
+	}
+
+	return "http"
+}
@@ -1,71 +1,354 @@
 package websocket
 
 import (
+	"bufio"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
-func newHandshakeError(w http.ResponseWriter, status int, reason string) error {
-	err := HandshakeError{reason: reason}
-	http.Error(w, err.Error(), status)
-
-	return err
-}
-
 var handshakeResponseTemplate = strings.Join([]string{
 	"HTTP/1.1 101 Switching Protocols",
-	"Server: go/ws-custom-server",
 	"Upgrade: WebSocket",
 	"Connection: Upgrade",
 	"Sec-WebSocket-Accept: %s",
-	"", // required for extra CRLF
-	"", // required for extra CRLF
+	"%s", // optional headers, each of them ends with CRLF
+	"",   // required for extra CRLF
 }, "\r\n")
 
-// Upgrade upgrades the HTTP connection protocol to WebSocket protocol.
+const defaultServerHeader = "go/ws-custom-server"
+
+// reservedResponseHeaders are the headers which are set by the Upgrader itself
+// and can't be passed in the response header.
+var reservedResponseHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-WebSocket-Accept",
+	"Sec-WebSocket-Extensions",
+	"Sec-WebSocket-Protocol",
+}
+
+var defaultUpgrader = &Upgrader{}
+
+// Upgrader is a type which represents the server settings to upgrade
+// the HTTP connection protocol to WebSocket protocol.
+type Upgrader struct {
+	// HandshakeTimeout specifies the duration for the handshake response to be written.
+	// Zero means no timeout.
+	HandshakeTimeout time.Duration
+
+	// ReadBufferSize and WriteBufferSize specify the sizes of the connection's
+	// I/O buffers in bytes. If a buffer size is zero, the buffer allocated
+	// by the HTTP server is used. WriteBufferSize also specifies the size of the
+	// message writer's buffer, which is the maximum payload size of the frames
+	// written by the message writer (4096 bytes by default).
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// WriteBufferPool specifies the pool of the message writer's buffers. The buffer
+	// is taken from the pool only while the message is being written, which saves
+	// the memory of the idle connections. The pool should be shared between the
+	// connections with the same WriteBufferSize. If WriteBufferPool is nil, every
+	// connection allocates its own buffer.
+	WriteBufferPool BufferPool
+
+	// ReadBufferPool specifies the pool of the buffers used by Conn.ReadMessage.
+	// See Conn.SetReadBufferPool for details.
+	ReadBufferPool BufferPool
+
+	// ReadLimit and FrameReadLimit specify the maximum sizes in bytes of the message
+	// and the frame payload received from the peer. Zero means no limit.
+	// See Conn.SetReadLimit and Conn.SetFrameReadLimit for details.
+	ReadLimit      int64
+	FrameReadLimit int64
+
+	// KeepaliveInterval and KeepaliveTimeout enable the keepalive of the connection
+	// if KeepaliveInterval is positive. See Conn.EnableKeepalive for details.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+
+	// CheckOrigin returns true if the request Origin header is acceptable.
+	// If CheckOrigin is nil, the request is accepted if it has no Origin header,
+	// if the origin host is equal to the Host header or if it matches AllowedOrigins.
+	// The rejected request is replied with 403 Forbidden status.
+	CheckOrigin func(req *http.Request) bool
+	// AllowedOrigins specifies the cross origin hosts which are accepted if CheckOrigin
+	// is nil. The patterns are matched against the origin host (including the port)
+	// case-insensitively using path.Match syntax, e.g. "*.example.com" or "localhost:*".
+	AllowedOrigins []string
+
+	// Subprotocols specifies the server's supported protocols in order of preference.
+	// The first protocol which is also requested by the client is selected.
+	Subprotocols []string
+	// SelectSubprotocol selects the subprotocol from the protocols requested
+	// by the client. If SelectSubprotocol is set, Subprotocols is ignored. The returned
+	// protocol must be one of the requested ones, otherwise no subprotocol is selected.
+	SelectSubprotocol func(req *http.Request, requested []string) string
+
+	// EnableCompression specifies whether the server should accept
+	// the permessage-deflate extension (RFC 7692) offered by the client.
+	EnableCompression bool
+	// CompressionOptions specifies the permessage-deflate parameters which
+	// the server requires in addition to the client's offer.
+	CompressionOptions CompressionOptions
+
+	// Error specifies the function for generating HTTP error responses.
+	// If Error is nil, http.Error is used to generate the response.
+	Error func(w http.ResponseWriter, req *http.Request, status int, reason error)
+}
+
+// Upgrade upgrades the HTTP connection protocol to WebSocket protocol using
+// the Upgrader with default settings. The permessage-deflate extension isn't
+// accepted, use Upgrader.EnableCompression to enable it. Only same origin
+// requests are allowed.
 func Upgrade(w http.ResponseWriter, req *http.Request) (*Conn, error) {
-	if req.Method != http.MethodGet {
-		return nil, newHandshakeError(w, http.StatusMethodNotAllowed, "request to upgrade is not GET")
+	return defaultUpgrader.Upgrade(w, req, nil)
+}
+
+// Upgrade upgrades the HTTP connection protocol to WebSocket protocol.
+//
+// The responseHeader is included in the response to the client's upgrade request.
+// Use it to specify cookies (Set-Cookie) and other application headers. The headers
+// negotiated by the Upgrader itself can't be set in the responseHeader.
+//
+// If the upgrade fails, Upgrade replies to the client with an HTTP error response
+// and returns HandshakeError.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, req *http.Request, responseHeader http.Header) (*Conn, error) {
+	if err := u.checkRequest(w, req, responseHeader); err != nil {
+		return nil, err
 	}
 
-	if !checkHeaderContains(req.Header, "Connection", "Upgrade") {
-		return nil, newHandshakeError(w, http.StatusBadRequest, "upgrade not found in Connection header")
+	subprotocol := u.selectSubprotocol(req)
+	params, compress := u.acceptCompression(req.Header)
+
+	netConn, rw, err := u.hijack(w, req)
+	if err != nil {
+		return nil, err
 	}
 
-	if !checkHeaderContains(req.Header, "Upgrade", "WebSocket") {
-		return nil, newHandshakeError(w, http.StatusBadRequest, "websocket not found in Upgrade header")
+	header := http.Header{"Server": {defaultServerHeader}}
+	for key, values := range responseHeader {
+		header[http.CanonicalHeaderKey(key)] = values
 	}
 
-	if !checkHeaderContains(req.Header, "Sec-WebSocket-Version", "13") {
-		return nil, newHandshakeError(w, http.StatusBadRequest, "unsupported version for upgrade to websocket")
+	if subprotocol != "" {
+		header.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+
+	if compress {
+		header.Set("Sec-WebSocket-Extensions", params.String())
+	}
+
+	if err = u.writeResponse(netConn, req, header); err != nil {
+		_ = netConn.Close()
+
+		return nil, err
+	}
+
+	if u.ReadBufferSize != 0 {
+		rw.Reader = bufio.NewReaderSize(netConn, u.ReadBufferSize)
+	}
+
+	if u.WriteBufferSize != 0 {
+		rw.Writer = bufio.NewWriterSize(netConn, u.WriteBufferSize)
 	}
 
-	clientSecret := req.Header.Get("Sec-WebSocket-Key")
-	if clientSecret == "" {
-		return nil, newHandshakeError(w, http.StatusBadRequest, "Sec-Websocket-Key header is missing or blank")
+	conn := newConn(netConn, rw, true)
+	conn.subprotocol = subprotocol
+	conn.request = req
+	conn.configure(connOptions{
+		writeBufferSize:   u.WriteBufferSize,
+		writeBufferPool:   u.WriteBufferPool,
+		readBufferPool:    u.ReadBufferPool,
+		readLimit:         u.ReadLimit,
+		frameReadLimit:    u.FrameReadLimit,
+		keepaliveInterval: u.KeepaliveInterval,
+		keepaliveTimeout:  u.KeepaliveTimeout,
+	})
+
+	if compress {
+		conn.enableCompression(params)
 	}
 
+	return conn, nil
+}
+
+// hijack takes over the connection of the handshake request.
+func (u *Upgrader) hijack(w http.ResponseWriter, req *http.Request) (net.Conn, *bufio.ReadWriter, error) {
 	hj, ok := w.(http.Hijacker)
 	if !ok {
-		return nil, newHandshakeError(w, http.StatusInternalServerError, "can't get control over tcp connection")
+		return nil, nil, u.returnError(
+			w, req, http.StatusInternalServerError, HandshakeInternalError, "can't get control over tcp connection",
+		)
 	}
 
 	netConn, rw, err := hj.Hijack()
 	if err != nil {
-		return nil, newHandshakeError(w, http.StatusInternalServerError, err.Error())
+		return nil, nil, u.returnError(w, req, http.StatusInternalServerError, HandshakeInternalError, err.Error())
 	}
 
-	rawResp := fmt.Sprintf(handshakeResponseTemplate, hashWebsocketKey(clientSecret))
-	if _, err = netConn.Write([]byte(rawResp)); err != nil {
+	if rw.Reader.Buffered() > 0 {
 		_ = netConn.Close()
 
-		return nil, err
+		return nil, nil, newHandshakeError(HandshakeBadRequest, 0, "client sent data before handshake is complete")
+	}
+
+	return netConn, rw, nil
+}
+
+// checkRequest validates the client's upgrade request and the application's response header.
+func (u *Upgrader) checkRequest(w http.ResponseWriter, req *http.Request, responseHeader http.Header) error {
+	if req.Method != http.MethodGet {
+		return u.returnError(w, req, http.StatusMethodNotAllowed, HandshakeBadRequest, "request to upgrade is not GET")
+	}
+
+	if !checkHeaderContains(req.Header, "Connection", "Upgrade") {
+		return u.returnError(
+			w, req, http.StatusBadRequest, HandshakeBadRequest, "upgrade not found in Connection header",
+		)
+	}
+
+	if !checkHeaderContains(req.Header, "Upgrade", "WebSocket") {
+		return u.returnError(
+			w, req, http.StatusBadRequest, HandshakeBadRequest, "websocket not found in Upgrade header",
+		)
+	}
+
+	if !checkHeaderContains(req.Header, "Sec-WebSocket-Version", "13") {
+		return u.returnError(
+			w, req, http.StatusBadRequest, HandshakeBadRequest, "unsupported version for upgrade to websocket",
+		)
+	}
+
+	if req.Header.Get("Sec-WebSocket-Key") == "" {
+		return u.returnError(
+			w, req, http.StatusBadRequest, HandshakeBadRequest, "Sec-Websocket-Key header is missing or blank",
+		)
+	}
+
+	for _, key := range reservedResponseHeaders {
+		if _, ok := responseHeader[http.CanonicalHeaderKey(key)]; ok {
+			return u.returnError(
+				w, req, http.StatusInternalServerError, HandshakeReservedHeader, key+" header can't be set by the application",
+			)
+		}
+	}
+
+	if !u.checkOrigin(req) {
+		return u.returnError(w, req, http.StatusForbidden, HandshakeForbiddenOrigin, "request origin is not allowed")
+	}
+
+	return nil
+}
+
+func (u *Upgrader) checkOrigin(req *http.Request) bool {
+	if u.CheckOrigin != nil {
+		return u.CheckOrigin(req)
+	}
+
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	if strings.EqualFold(originURL.Host, req.Host) {
+		return true
+	}
+
+	return matchOrigin(originURL.Host, u.AllowedOrigins)
+}
+
+// writeResponse writes the handshake response with the passed headers to the hijacked connection.
+func (u *Upgrader) writeResponse(netConn net.Conn, req *http.Request, header http.Header) error {
+	var headerBuilder strings.Builder
+	if err := header.Write(&headerBuilder); err != nil {
+		return err
+	}
+
+	if u.HandshakeTimeout != 0 {
+		if err := netConn.SetWriteDeadline(time.Now().Add(u.HandshakeTimeout)); err != nil {
+			return err
+		}
+	}
+
+	accept := hashWebsocketKey(req.Header.Get("Sec-WebSocket-Key"))
+
+	rawResp := fmt.Sprintf(handshakeResponseTemplate, accept, headerBuilder.String())
+	if _, err := netConn.Write([]byte(rawResp)); err != nil {
+		return err
+	}
+
+	if u.HandshakeTimeout != 0 {
+		return netConn.SetWriteDeadline(time.Time{})
+	}
+
+	return nil
+}
+
+func (u *Upgrader) returnError(
+	w http.ResponseWriter, req *http.Request, status int, reason HandshakeReason, text string,
+) error {
+	err := newHandshakeError(reason, status, text)
+	if u.Error != nil {
+		u.Error(w, req, status, err)
+	} else {
+		http.Error(w, err.Error(), status)
+	}
+
+	return err
+}
+
+// Subprotocols returns the subprotocols requested by the client
+// in the Sec-WebSocket-Protocol header.
+func Subprotocols(req *http.Request) []string {
+	return headerValues(req.Header, "Sec-WebSocket-Protocol")
+}
+
+// selectSubprotocol returns the subprotocol selected by the SelectSubprotocol callback
+// or the first server's subprotocol requested by the client.
+func (u *Upgrader) selectSubprotocol(req *http.Request) string {
+	requested := Subprotocols(req)
+	if len(requested) == 0 {
+		return ""
+	}
+
+	if u.SelectSubprotocol != nil {
+		subprotocol := u.SelectSubprotocol(req, requested)
+		if containsString(requested, subprotocol) {
+			return subprotocol
+		}
+
+		return ""
+	}
+
+	for _, subprotocol := range u.Subprotocols {
+		if containsString(requested, subprotocol) {
+			return subprotocol
+		}
+	}
+
+	return ""
+}
+
+// acceptCompression returns the parameters of the permessage-deflate extension
+// if the client has offered it. The malformed header is ignored.
+func (u *Upgrader) acceptCompression(header http.Header) (deflateParams, bool) {
+	if !u.EnableCompression {
+		return deflateParams{}, false
+	}
+
+	offers, err := parseExtensions(header)
+	if err != nil {
+		return deflateParams{}, false
 	}
 
-	return &Conn{
-		isServer: true,
-		conn:     netConn,
-		rw:       rw,
-	}, nil
+	return acceptDeflateOffer(offers, u.CompressionOptions)
 }
@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	acceptAll := func(*http.Request) bool { return true }
+	rejectAll := func(*http.Request) bool { return false }
+
+	tests := []struct {
+		name           string
+		origin         string
+		allowedOrigins []string
+		checkOrigin    func(req *http.Request) bool
+		want           bool
+	}{
+		{
+			name: "no origin",
+			want: true,
+		},
+		{
+			name:           "null origin",
+			origin:         "null",
+			allowedOrigins: []string{"*"},
+			want:           false,
+		},
+		{
+			name:   "same host",
+			origin: "https://Example.com",
+			want:   true,
+		},
+		{
+			name:   "same host with other port",
+			origin: "https://example.com:8080",
+			want:   false,
+		},
+		{
+			name:           "allowed port",
+			origin:         "https://example.com:8080",
+			allowedOrigins: []string{"example.com:8080"},
+			want:           true,
+		},
+		{
+			name:   "cross origin",
+			origin: "https://evil.com",
+			want:   false,
+		},
+		{
+			name:           "wildcard subdomain",
+			origin:         "https://API.example.com",
+			allowedOrigins: []string{"*.example.com"},
+			want:           true,
+		},
+		{
+			name:           "wildcard doesn't match parent domain",
+			origin:         "https://example.org",
+			allowedOrigins: []string{"*.example.org"},
+			want:           false,
+		},
+		{
+			name:           "malformed pattern",
+			origin:         "https://api.example.org",
+			allowedOrigins: []string{"[*.example.org"},
+			want:           false,
+		},
+		{
+			name:        "CheckOrigin accepts cross origin",
+			origin:      "https://evil.com",
+			checkOrigin: acceptAll,
+			want:        true,
+		},
+		{
+			name:           "CheckOrigin overrides allowed origins",
+			origin:         "https://example.com",
+			allowedOrigins: []string{"example.com"},
+			checkOrigin:    rejectAll,
+			want:           false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+
+			u := &Upgrader{AllowedOrigins: tt.allowedOrigins, CheckOrigin: tt.checkOrigin}
+			if got := u.checkOrigin(req); got != tt.want {
+				t.Fatalf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
@@ -4,23 +4,75 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
-	rnd "math/rand"
+	"errors"
+	"net"
 	"net/http"
-	"net/url"
+	"path"
 	"strings"
+	"unicode/utf8"
 )
 
 // keyGUID (Globally Unique Identifier).
 var keyGUID = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
 
-func newMaskKey() [4]byte {
-	n := rnd.Uint32()
+// checkHeaderContains reports whether the comma-separated list of the header
+// values contains the value. Comparison is case-insensitive.
+func checkHeaderContains(header http.Header, key string, value string) bool {
+	for _, v := range headerValues(header, key) {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
 
-	return [4]byte{byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)}
+	return false
 }
 
-func checkHeaderContains(header http.Header, key string, value string) bool {
-	return header.Get(key) == value
+// headerValues returns the non-empty elements of the comma-separated list of the header values.
+func headerValues(header http.Header, key string) []string {
+	var values []string
+
+	for _, list := range header.Values(key) {
+		for _, v := range strings.Split(list, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+
+	return values
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchOrigin reports whether the origin host matches any of the patterns.
+func matchOrigin(host string, patterns []string) bool {
+	if host == "" {
+		return false
+	}
+
+	host = strings.ToLower(host)
+
+	for _, pattern := range patterns {
+		if ok, err := path.Match(strings.ToLower(pattern), host); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
 func hashWebsocketKey(key string) string {
@@ -40,18 +92,138 @@ func randomWebsocketKey() (string, error) {
 	return base64.StdEncoding.EncodeToString(buf), nil
 }
 
-func extractHostPort(addr *url.URL) string {
-	hostPort := addr.Host
-	if strings.ContainsRune(hostPort, ':') {
-		return hostPort
+// extension is a type which represents an element of the Sec-WebSocket-Extensions header.
+type extension struct {
+	name   string
+	params map[string]string
+}
+
+// parseExtensions parses the extension list of the Sec-WebSocket-Extensions headers
+// defined in RFC 6455 (9.1). The parameter without value is stored with an empty value.
+func parseExtensions(header http.Header) ([]extension, error) {
+	var exts []extension
+
+	for _, value := range header.Values("Sec-WebSocket-Extensions") {
+		for _, element := range strings.Split(value, ",") {
+			element = strings.TrimSpace(element)
+			if element == "" {
+				continue
+			}
+
+			ext, err := parseExtension(element)
+			if err != nil {
+				return nil, err
+			}
+
+			exts = append(exts, ext)
+		}
+	}
+
+	return exts, nil
+}
+
+func parseExtension(element string) (extension, error) {
+	parts := strings.Split(element, ";")
+	ext := extension{
+		name:   strings.ToLower(strings.TrimSpace(parts[0])),
+		params: make(map[string]string, len(parts)-1),
 	}
 
-	switch addr.Scheme {
-	case "https", "wss":
-		hostPort += ":443"
-	default:
-		hostPort += ":80"
+	if !isToken(ext.name) {
+		return ext, errInvalidExtensions
 	}
 
-	return hostPort
+	for _, param := range parts[1:] {
+		name, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			name, value = param[:i], strings.TrimSpace(param[i+1:])
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+
+			if !isToken(value) {
+				return ext, errInvalidExtensions
+			}
+		}
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !isToken(name) {
+			return ext, errInvalidExtensions
+		}
+
+		if _, ok := ext.params[name]; ok {
+			return ext, errInvalidExtensions
+		}
+
+		ext.params[name] = value
+	}
+
+	return ext, nil
+}
+
+// isToken reports whether s is a token defined in RFC 7230 (3.2.6).
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isTokenChar(c byte) bool {
+	if c <= ' ' || c >= 0x7f {
+		return false
+	}
+
+	return !strings.ContainsRune("\"(),/:;<=>?@[\\]{}", rune(c))
+}
+
+// utf8Validator is a type which validates UTF-8 text received in chunks.
+// The rune split between the chunks is kept until the next chunk.
+type utf8Validator struct {
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+// write validates the next chunk of the text.
+func (v *utf8Validator) write(p []byte) bool {
+	for v.n > 0 && len(p) > 0 {
+		v.pending[v.n] = p[0]
+		v.n++
+		p = p[1:]
+
+		if utf8.FullRune(v.pending[:v.n]) {
+			r, size := utf8.DecodeRune(v.pending[:v.n])
+			v.n = 0
+
+			if r == utf8.RuneError && size == 1 {
+				return false
+			}
+		}
+	}
+
+	// Keep the incomplete rune at the end of the chunk.
+	for i := len(p) - 1; i >= 0 && i > len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				v.n = copy(v.pending[:], p[i:])
+				p = p[:i]
+			}
+
+			break
+		}
+	}
+
+	return utf8.Valid(p)
+}
+
+// done reports whether the text doesn't end with the incomplete rune.
+func (v *utf8Validator) done() bool {
+	return v.n == 0
 }
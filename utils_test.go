@@ -0,0 +1,103 @@
+package websocket
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseExtensions(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    []extension
+		wantErr bool
+	}{
+		{
+			name:   "no header",
+			values: nil,
+			want:   nil,
+		},
+		{
+			name:   "extension without params",
+			values: []string{"permessage-deflate"},
+			want:   []extension{{name: "permessage-deflate", params: map[string]string{}}},
+		},
+		{
+			name:   "params with and without value",
+			values: []string{"permessage-deflate; client_max_window_bits; server_max_window_bits=10"},
+			want: []extension{{
+				name:   "permessage-deflate",
+				params: map[string]string{"client_max_window_bits": "", "server_max_window_bits": "10"},
+			}},
+		},
+		{
+			name:   "quoted value",
+			values: []string{`permessage-deflate; server_max_window_bits="10"`},
+			want: []extension{{
+				name:   "permessage-deflate",
+				params: map[string]string{"server_max_window_bits": "10"},
+			}},
+		},
+		{
+			name:   "case and whitespace",
+			values: []string{" Permessage-Deflate ;  Server_No_Context_Takeover "},
+			want: []extension{{
+				name:   "permessage-deflate",
+				params: map[string]string{"server_no_context_takeover": ""},
+			}},
+		},
+		{
+			name:   "list across headers",
+			values: []string{"foo, permessage-deflate; client_no_context_takeover", ",bar"},
+			want: []extension{
+				{name: "foo", params: map[string]string{}},
+				{name: "permessage-deflate", params: map[string]string{"client_no_context_takeover": ""}},
+				{name: "bar", params: map[string]string{}},
+			},
+		},
+		{
+			name:    "empty name",
+			values:  []string{"; client_no_context_takeover"},
+			wantErr: true,
+		},
+		{
+			name:    "empty value",
+			values:  []string{"permessage-deflate; server_max_window_bits="},
+			wantErr: true,
+		},
+		{
+			name:    "value isn't token",
+			values:  []string{`permessage-deflate; server_max_window_bits="1 0"`},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate param",
+			values:  []string{"permessage-deflate; client_no_context_takeover; client_no_context_takeover"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Sec-Websocket-Extensions": tt.values}
+
+			got, err := parseExtensions(header)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -1,49 +1,65 @@
 package websocket
 
+import (
+	"context"
+	"io"
+)
+
 const defaultWriteBufferSize = 4096
 
 type messageWriter struct {
 	conn        *Conn
 	messageType byte
 	wasFragment bool
+	compressed  bool
+	closed      bool
 
+	// buff has maxFrameHeaderSize bytes reserved for the frame header
+	// followed by the payload of the frame, which ends at pos.
 	pos  int
-	buff []byte
+	buff *[]byte
 }
 
-func newMessageWriter(conn *Conn, frameType byte) *messageWriter {
+// newMessageWriter returns a new message writer. The caller must hold writeSem.
+func newMessageWriter(conn *Conn, messageType byte) *messageWriter {
 	return &messageWriter{
 		conn:        conn,
-		messageType: frameType,
-		buff:        make([]byte, defaultWriteBufferSize),
+		messageType: messageType,
+		pos:         maxFrameHeaderSize,
+		buff:        conn.getWriteBuffer(),
 	}
 }
 
 func (w *messageWriter) Write(p []byte) (int, error) {
-	if w.conn.closeErr != nil {
-		return 0, w.conn.closeErr
+	if w.closed {
+		return 0, errWriterClosed
+	}
+
+	if closeErr := w.conn.getCloseError(); closeErr != nil {
+		return 0, closeErr
 	}
 
+	buff := *w.buff
 	n := 0
 
 	for len(p) > 0 {
-		if len(w.buff[w.pos:]) == 0 {
-			fr := frame{
-				isFragment: true,
-				opcode:     w.getOpcode(),
-				payload:    w.buff,
+		if w.pos == len(buff) {
+			if err := w.flush(false); err != nil {
+				return n, err
 			}
+		}
 
-			err := w.conn.send(fr)
-			if err != nil {
-				return 0, err
+		// The chunk which doesn't fit into the empty buffer is sent
+		// as the frame without copying it into the buffer.
+		if w.pos == maxFrameHeaderSize && len(p) > len(buff)-maxFrameHeaderSize {
+			if err := w.send(p); err != nil {
+				return n, err
 			}
 
-			w.pos = 0
-			w.wasFragment = true
+			return n + len(p), nil
 		}
 
-		nn := copy(w.buff[w.pos:], p)
+		nn := copy(buff[w.pos:], p)
 		p = p[nn:]
 
 		n += nn
@@ -53,6 +69,36 @@ func (w *messageWriter) Write(p []byte) (int, error) {
 	return n, nil
 }
 
+// flush sends the buffered payload as the frame.
+func (w *messageWriter) flush(final bool) error {
+	fr := frame{
+		isFragment: !final,
+		reserved:   w.getReserved(),
+		opcode:     w.getOpcode(),
+	}
+
+	err := w.conn.sendBuffered(fr, (*w.buff)[:w.pos])
+
+	w.pos = maxFrameHeaderSize
+	w.wasFragment = true
+
+	return err
+}
+
+// send sends p as the non-final frame. The empty buffer is used to mask the payload.
+func (w *messageWriter) send(p []byte) error {
+	fr := frame{
+		isFragment: true,
+		reserved:   w.getReserved(),
+		opcode:     w.getOpcode(),
+		payload:    p,
+	}
+
+	w.wasFragment = true
+
+	return w.conn.send(fr, (*w.buff)[maxFrameHeaderSize:])
+}
+
 func (w *messageWriter) getOpcode() byte {
 	if w.wasFragment {
 		return ContinuationOpcode
@@ -61,19 +107,73 @@ func (w *messageWriter) getOpcode() byte {
 	return w.messageType
 }
 
+// getReserved returns RSV bits of the frame. Only the first frame
+// of the compressed message has RSV1 bit.
+func (w *messageWriter) getReserved() byte {
+	if w.compressed && !w.wasFragment {
+		return rsv1Bit
+	}
+
+	return 0
+}
+
+// Close flushes the last frame of the message and allows the next writer
+// to be opened. The repeated call has no effect.
 func (w *messageWriter) Close() error {
-	if w.conn.closeErr != nil {
-		return w.conn.closeErr
+	if w.closed {
+		return nil
 	}
 
-	fr := frame{
-		opcode:  w.getOpcode(),
-		payload: w.buff[:w.pos],
+	w.closed = true
+
+	defer w.release()
+
+	if closeErr := w.conn.getCloseError(); closeErr != nil {
+		return closeErr
 	}
 
-	if err := w.conn.send(fr); err != nil {
+	return w.flush(true)
+}
+
+// release returns the buffer and releases writeSem.
+func (w *messageWriter) release() {
+	w.conn.putWriteBuffer(w.buff)
+	w.buff = nil
+
+	<-w.conn.writeSem
+}
+
+// contextWriter is a type which aborts the writes of the message writer when ctx is done.
+type contextWriter struct {
+	ctx  context.Context
+	conn *Conn
+	w    io.WriteCloser
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	var n int
+
+	err := w.conn.doContext(w.ctx, true, func() error {
+		var err error
+		n, err = w.w.Write(p)
+
 		return err
+	})
+	if err != nil && w.ctx.Err() != nil {
+		_ = w.conn.closeNetConn()
+	}
+
+	return n, err
+}
+
+// Close flushes the last frame of the message. If ctx is done, the underlying
+// connection is closed and the writer is released without completing the message.
+func (w *contextWriter) Close() error {
+	err := w.conn.doContext(w.ctx, true, w.w.Close)
+	if err != nil && w.ctx.Err() != nil {
+		_ = w.conn.closeNetConn()
+		_ = w.w.Close()
 	}
 
-	return nil
+	return err
 }